@@ -0,0 +1,299 @@
+// Command mockidp is a minimal OpenID Connect provider for trying the
+// downloader's OIDC login locally. It signs everyone in as the configured
+// user without asking, so never expose it.
+//
+//	go run ./cmd/mockidp -addr :9000 -client-id viddown
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const keyID = "mock-1"
+
+type authCode struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	expires     time.Time
+}
+
+type mockIdP struct {
+	issuer   string
+	clientID string
+	secret   string
+	subject  string
+	email    string
+	name     string
+	tokenTTL time.Duration
+	key      *ecdsa.PrivateKey
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	codes   map[string]authCode
+	refresh map[string]bool
+}
+
+func main() {
+	addr := flag.String("addr", ":9000", "listen address")
+	issuer := flag.String("issuer", "http://localhost:9000", "issuer URL, as the downloader reaches it")
+	clientID := flag.String("client-id", "viddown", "accepted client ID")
+	secret := flag.String("client-secret", "", "client secret; empty accepts public clients")
+	subject := flag.String("sub", "mock-user", "subject of the signed-in user")
+	email := flag.String("email", "user@example.com", "email of the signed-in user")
+	name := flag.String("name", "Mock User", "name of the signed-in user")
+	tokenTTL := flag.Duration("token-ttl", 5*time.Minute, "ID token lifetime; keep it short to exercise refreshes")
+	flag.Parse()
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	idp, err := newMockIdP(*issuer, *clientID, *secret, logger)
+	if err != nil {
+		logger.Error("Failed to generate signing key", "error", err)
+		os.Exit(1)
+	}
+	idp.subject, idp.email, idp.name = *subject, *email, *name
+	idp.tokenTTL = *tokenTTL
+
+	logger.Info("Mock IdP listening", "addr", *addr, "issuer", *issuer)
+	if err := http.ListenAndServe(*addr, idp.routes()); err != nil {
+		logger.Error("Server error", "error", err)
+		os.Exit(1)
+	}
+}
+
+func newMockIdP(issuer, clientID, secret string, logger *slog.Logger) (*mockIdP, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &mockIdP{
+		issuer:   issuer,
+		clientID: clientID,
+		secret:   secret,
+		subject:  "mock-user",
+		email:    "user@example.com",
+		name:     "Mock User",
+		tokenTTL: 5 * time.Minute,
+		key:      key,
+		logger:   logger,
+		codes:    make(map[string]authCode),
+		refresh:  make(map[string]bool),
+	}, nil
+}
+
+func (m *mockIdP) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("GET /jwks", m.jwks)
+	mux.HandleFunc("GET /authorize", m.authorize)
+	mux.HandleFunc("POST /token", m.token)
+	mux.HandleFunc("GET /logout", m.logout)
+	return mux
+}
+
+func (m *mockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                m.issuer,
+		"authorization_endpoint":                m.issuer + "/authorize",
+		"token_endpoint":                        m.issuer + "/token",
+		"jwks_uri":                              m.issuer + "/jwks",
+		"end_session_endpoint":                  m.issuer + "/logout",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"id_token_signing_alg_values_supported": []string{"ES256"},
+		"subject_types_supported":               []string{"public"},
+	})
+}
+
+func (m *mockIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"crv": "P-256",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "ES256",
+			"x":   base64.RawURLEncoding.EncodeToString(m.key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(m.key.Y.FillBytes(make([]byte, 32))),
+		}},
+	})
+}
+
+// authorize approves every request and redirects back with a code
+func (m *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != m.clientID {
+		http.Error(w, "unsupported response_type or unknown client_id", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	m.mu.Lock()
+	m.codes[code] = authCode{
+		clientID:    m.clientID,
+		redirectURI: redirect.String(),
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		expires:     time.Now().Add(time.Minute),
+	}
+	m.mu.Unlock()
+
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	m.logger.Info("Authorized", "sub", m.subject, "redirect", redirect.Host)
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (m *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+	clientID, secret, hasBasic := r.BasicAuth()
+	if hasBasic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+	}
+	if clientID != m.clientID || secret != m.secret {
+		tokenError(w, "invalid_client")
+		return
+	}
+
+	var nonce string
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		m.mu.Lock()
+		code, ok := m.codes[r.PostForm.Get("code")]
+		delete(m.codes, r.PostForm.Get("code"))
+		m.mu.Unlock()
+
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || time.Now().After(code.expires) || code.redirectURI != r.PostForm.Get("redirect_uri") ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+			tokenError(w, "invalid_grant")
+			return
+		}
+		nonce = code.nonce
+	case "refresh_token":
+		// Refresh tokens rotate: each one works once
+		m.mu.Lock()
+		ok := m.refresh[r.PostForm.Get("refresh_token")]
+		delete(m.refresh, r.PostForm.Get("refresh_token"))
+		m.mu.Unlock()
+		if !ok {
+			tokenError(w, "invalid_grant")
+			return
+		}
+	default:
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	idToken, err := m.signIDToken(nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	refreshToken := randomString()
+	m.mu.Lock()
+	m.refresh[refreshToken] = true
+	m.mu.Unlock()
+
+	m.logger.Info("Issued tokens", "grant", r.PostForm.Get("grant_type"), "sub", m.subject)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token":  randomString(),
+		"token_type":    "Bearer",
+		"expires_in":    int(m.tokenTTL.Seconds()),
+		"id_token":      idToken,
+		"refresh_token": refreshToken,
+	})
+}
+
+// logout redirects back only with an id_token_hint, like most providers
+func (m *mockIdP) logout(w http.ResponseWriter, r *http.Request) {
+	if target := r.URL.Query().Get("post_logout_redirect_uri"); target != "" && r.URL.Query().Get("id_token_hint") != "" {
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	w.Write([]byte("Signed out\n"))
+}
+
+// signIDToken issues an ES256 ID token for the configured user
+func (m *mockIdP) signIDToken(nonce string) (string, error) {
+	now := time.Now()
+	claims := map[string]any{
+		"iss":   m.issuer,
+		"sub":   m.subject,
+		"aud":   m.clientID,
+		"email": m.email,
+		"name":  m.name,
+		"iat":   now.Unix(),
+		"exp":   now.Add(m.tokenTTL).Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "typ": "JWT", "kid": keyID})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	rInt, sInt, err := ecdsa.Sign(rand.Reader, m.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := append(fixed32(rInt), fixed32(sInt)...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func fixed32(n *big.Int) []byte {
+	return n.FillBytes(make([]byte, 32))
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
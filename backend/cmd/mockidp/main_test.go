@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"viddown/middleware"
+)
+
+type oidcTest struct {
+	idp       *mockIdP
+	app       *httptest.Server
+	refreshes atomic.Int32
+}
+
+// newOIDCTest runs the mock IdP and an app serving the auth routes the way
+// main.go mounts them
+func newOIDCTest(t *testing.T, tokenTTL time.Duration) *oidcTest {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ot := &oidcTest{}
+
+	var idpHandler http.Handler
+	idpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" && r.ParseForm() == nil && r.PostForm.Get("grant_type") == "refresh_token" {
+			ot.refreshes.Add(1)
+		}
+		idpHandler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(idpServer.Close)
+
+	idp, err := newMockIdP(idpServer.URL, "viddown", "", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.tokenTTL = tokenTTL
+	idpHandler = idp.routes()
+	ot.idp = idp
+
+	var appHandler http.Handler
+	ot.app = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		appHandler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ot.app.Close)
+
+	provider, err := middleware.NewOIDCProvider(middleware.OIDCConfig{
+		Issuer:        idpServer.URL,
+		ClientID:      "viddown",
+		RedirectURL:   ot.app.URL + "/api/auth/callback",
+		Scopes:        []string{"openid", "email", "profile"},
+		PostLogoutURL: ot.app.URL + "/",
+		SessionTTL:    time.Hour,
+		ClockSkew:     time.Minute,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/auth/login", provider.Login)
+	mux.HandleFunc("GET /api/auth/callback", provider.Callback)
+	mux.HandleFunc("POST /api/auth/logout", provider.Logout)
+	mux.HandleFunc("GET /api/auth/me", provider.Me)
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {})
+	appHandler = mux
+	return ot
+}
+
+// client returns a browser-like client that doesn't follow redirects
+func (ot *oidcTest) client(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func get(t *testing.T, c *http.Client, rawURL string) *http.Response {
+	t.Helper()
+	resp, err := c.Get(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// authorize runs login and the IdP's authorize step, returning the callback
+// URL the IdP redirected to. tamper may change the authorize URL first.
+func (ot *oidcTest) authorize(t *testing.T, c *http.Client, tamper func(url.Values)) *url.URL {
+	t.Helper()
+	resp := get(t, c, ot.app.URL+"/api/auth/login?return_to=/api/auth/me")
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("login status = %d, want 302", resp.StatusCode)
+	}
+	authorizeURL, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tamper != nil {
+		query := authorizeURL.Query()
+		tamper(query)
+		authorizeURL.RawQuery = query.Encode()
+	}
+
+	resp = get(t, c, authorizeURL.String())
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize status = %d, want 302", resp.StatusCode)
+	}
+	callbackURL, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return callbackURL
+}
+
+func (ot *oidcTest) me(t *testing.T, c *http.Client) (int, middleware.User) {
+	t.Helper()
+	resp, err := c.Get(ot.app.URL + "/api/auth/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var user middleware.User
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, user
+}
+
+func (ot *oidcTest) logout(t *testing.T, c *http.Client, origin string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, ot.app.URL+"/api/auth/logout", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", origin)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestOIDCFlow(t *testing.T) {
+	// Tokens expire on issue, so every session check has to refresh; the
+	// clock skew still lets the callback accept them
+	ot := newOIDCTest(t, -time.Second)
+	c := ot.client(t)
+
+	callbackURL := ot.authorize(t, c, nil)
+	resp := get(t, c, callbackURL.String())
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("callback status = %d, want 302", resp.StatusCode)
+	}
+	if location := resp.Header.Get("Location"); location != "/api/auth/me" {
+		t.Fatalf("callback redirected to %q, want return_to", location)
+	}
+
+	for i := 1; i <= 2; i++ {
+		status, user := ot.me(t, c)
+		if status != http.StatusOK {
+			t.Fatalf("me status = %d, want 200", status)
+		}
+		if user.ID != ot.idp.subject || user.Email != ot.idp.email {
+			t.Fatalf("me = %+v, want the mock user", user)
+		}
+		// The rotated refresh token has to be stored for the next refresh
+		if got := ot.refreshes.Load(); got != int32(i) {
+			t.Fatalf("refreshes = %d, want %d", got, i)
+		}
+	}
+
+	if resp := ot.logout(t, c, "https://evil.example"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("cross-site logout status = %d, want 403", resp.StatusCode)
+	}
+	if status, _ := ot.me(t, c); status != http.StatusOK {
+		t.Fatalf("cross-site logout ended the session: me status = %d", status)
+	}
+
+	resp = ot.logout(t, c, ot.app.URL)
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("logout status = %d, want 303", resp.StatusCode)
+	}
+	endSession, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endSession.Query().Get("id_token_hint") == "" {
+		t.Fatal("logout sent no id_token_hint")
+	}
+	resp = get(t, c, endSession.String())
+	if location := resp.Header.Get("Location"); location != ot.app.URL+"/" {
+		t.Fatalf("IdP logout redirected to %q, want the post-logout URL", location)
+	}
+	if status, _ := ot.me(t, c); status != http.StatusUnauthorized {
+		t.Fatalf("me after logout status = %d, want 401", status)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	tests := []struct {
+		name           string
+		tamperAuth     func(url.Values)
+		tamperCallback func(url.Values)
+		want           int
+	}{
+		{
+			name:           "bad state",
+			tamperCallback: func(q url.Values) { q.Set("state", q.Get("state")+"x") },
+			want:           http.StatusBadRequest,
+		},
+		{
+			name:       "wrong nonce",
+			tamperAuth: func(q url.Values) { q.Set("nonce", "attacker-nonce") },
+			want:       http.StatusUnauthorized,
+		},
+		{
+			name:           "unknown code",
+			tamperCallback: func(q url.Values) { q.Set("code", "unknown-code") },
+			want:           http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ot := newOIDCTest(t, time.Minute)
+			c := ot.client(t)
+
+			callbackURL := ot.authorize(t, c, tt.tamperAuth)
+			if tt.tamperCallback != nil {
+				query := callbackURL.Query()
+				tt.tamperCallback(query)
+				callbackURL.RawQuery = query.Encode()
+			}
+			if resp := get(t, c, callbackURL.String()); resp.StatusCode != tt.want {
+				t.Fatalf("callback status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if status, _ := ot.me(t, c); status != http.StatusUnauthorized {
+				t.Fatalf("me status = %d, want 401 without a session", status)
+			}
+		})
+	}
+}
@@ -2,17 +2,71 @@ package config
 
 import (
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
 	Port          string
 	AuthRequired  bool
 	MaxConcurrent int
+	MaxPerClient  int
+	QueueMaxDepth int
+	QueueMaxWait  time.Duration
 	RateLimitRPM  int
 	YtDlpPath     string
+	FFmpegPath    string
 	CookiesFile   string
 	ProxyURL      string
+	JobTTL        time.Duration
+	Resolutions   []int
+	PresetsFile   string
+
+	AnalyzeCacheTTL  time.Duration
+	AnalyzeCacheSize int
+
+	CacheDir       string
+	CacheMaxSizeMB int64
+	CacheTTL       time.Duration
+
+	MergeStrategy       string
+	DownloadMaxRetries  int
+	DownloadConnections int
+	DownloadChunkSizeMB int64
+
+	// DownloadTokenKeys are "id:secret" pairs, comma-separated; the first
+	// signs new tokens
+	DownloadTokenKeys   string
+	DownloadTokenTTL    time.Duration
+	DownloadLegacyLinks bool
+
+	ThumbnailHosts     []string
+	ThumbnailMaxSizeKB int
+
+	// Proxies whose X-Real-IP and X-Forwarded-For headers are believed
+	TrustedProxies []string
+
+	AuthProvider     string // none, jwt or oidc
+	JWTSecret        string
+	JWTPublicKeyFile string
+	JWTJWKSFile      string
+	JWTJWKSReload    time.Duration
+	JWTIssuer        string
+	JWTAudience      string
+	JWTClockSkew     time.Duration
+
+	// OIDC login for the web UI (AUTH_PROVIDER=oidc)
+	OIDCIssuer        string
+	OIDCClientID      string
+	OIDCClientSecret  string
+	OIDCRedirectURL   string
+	OIDCScopes        []string
+	OIDCPostLogoutURL string
+	SessionKey        string // Base64 AES-256 key for session cookies
+	SessionTTL        time.Duration
+	CookieSecure      bool
 }
 
 func Load() *Config {
@@ -20,10 +74,57 @@ func Load() *Config {
 		Port:          getEnv("PORT", "8080"),
 		AuthRequired:  getEnvBool("AUTH_REQUIRED", false),
 		MaxConcurrent: getEnvInt("MAX_CONCURRENT", 5),
+		MaxPerClient:  getEnvInt("MAX_PER_CLIENT", 2),
+		QueueMaxDepth: getEnvInt("QUEUE_MAX_DEPTH", 50),
+		QueueMaxWait:  getEnvDuration("QUEUE_MAX_WAIT", 10*time.Minute),
 		RateLimitRPM:  getEnvInt("RATE_LIMIT_RPM", 30),
 		YtDlpPath:     getEnv("YTDLP_PATH", "/usr/local/bin/yt-dlp"),
+		FFmpegPath:    getEnv("FFMPEG_PATH", "ffmpeg"),
 		CookiesFile:   getEnv("COOKIES_FILE", ""),
 		ProxyURL:      getEnv("PROXY_URL", ""),
+		JobTTL:        getEnvDuration("JOB_TTL", time.Hour),
+		Resolutions:   getEnvIntList("RESOLUTIONS", []int{360, 480, 720, 1080, 1440, 2160}),
+		PresetsFile:   getEnv("PRESETS_FILE", ""),
+
+		AnalyzeCacheTTL:  getEnvDuration("ANALYZE_CACHE_TTL", 30*time.Minute),
+		AnalyzeCacheSize: getEnvInt("ANALYZE_CACHE_SIZE", 1000),
+
+		CacheDir:       getEnv("CACHE_DIR", "/tmp/viddown/cache"),
+		CacheMaxSizeMB: int64(getEnvInt("CACHE_MAX_SIZE_MB", 2048)),
+		CacheTTL:       getEnvDuration("CACHE_TTL", 24*time.Hour),
+
+		MergeStrategy:       getEnv("MERGE_STRATEGY", "fmp4"),
+		DownloadMaxRetries:  getEnvInt("DOWNLOAD_MAX_RETRIES", 5),
+		DownloadConnections: getEnvInt("DOWNLOAD_CONNECTIONS", 4),
+		DownloadChunkSizeMB: int64(getEnvInt("DOWNLOAD_CHUNK_SIZE_MB", 8)),
+
+		DownloadTokenKeys:   getEnv("DOWNLOAD_TOKEN_KEYS", ""),
+		DownloadTokenTTL:    getEnvDuration("DOWNLOAD_TOKEN_TTL", 6*time.Hour),
+		DownloadLegacyLinks: getEnvBool("DOWNLOAD_LEGACY_LINKS", false),
+
+		ThumbnailHosts:     getEnvList("THUMBNAIL_HOSTS", nil),
+		ThumbnailMaxSizeKB: getEnvInt("THUMBNAIL_MAX_SIZE_KB", 5120),
+
+		TrustedProxies: getEnvList("TRUSTED_PROXIES", []string{"127.0.0.1/8", "::1/128"}),
+
+		AuthProvider:     getEnv("AUTH_PROVIDER", "none"),
+		JWTSecret:        getEnv("JWT_SECRET", ""),
+		JWTPublicKeyFile: getEnv("JWT_PUBLIC_KEY_FILE", ""),
+		JWTJWKSFile:      getEnv("JWT_JWKS_FILE", ""),
+		JWTJWKSReload:    getEnvDuration("JWT_JWKS_RELOAD", 5*time.Minute),
+		JWTIssuer:        getEnv("JWT_ISSUER", ""),
+		JWTAudience:      getEnv("JWT_AUDIENCE", ""),
+		JWTClockSkew:     getEnvDuration("JWT_CLOCK_SKEW", time.Minute),
+
+		OIDCIssuer:        getEnv("OIDC_ISSUER", ""),
+		OIDCClientID:      getEnv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:  getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:   getEnv("OIDC_REDIRECT_URL", ""),
+		OIDCScopes:        getEnvList("OIDC_SCOPES", []string{"openid", "email", "profile"}),
+		OIDCPostLogoutURL: getEnv("OIDC_POST_LOGOUT_URL", "/"),
+		SessionKey:        getEnv("SESSION_KEY", ""),
+		SessionTTL:        getEnvDuration("SESSION_TTL", 24*time.Hour),
+		CookieSecure:      getEnvBool("COOKIE_SECURE", true),
 	}
 }
 
@@ -52,3 +153,46 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getEnvIntList parses a comma-separated list of positive integers, sorted
+// ascending
+func getEnvIntList(key string, defaultValue []int) []int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var list []int
+	for _, part := range strings.Split(value, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || i <= 0 {
+			return defaultValue
+		}
+		list = append(list, i)
+	}
+	sort.Ints(list)
+	return list
+}
+
+func getEnvList(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var list []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.ToLower(strings.TrimSpace(part)); part != "" {
+			list = append(list, part)
+		}
+	}
+	return list
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
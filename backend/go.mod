@@ -8,4 +8,4 @@ require (
 	golang.org/x/time v0.5.0
 )
 
-require golang.org/x/net v0.50.0 // indirect
+require golang.org/x/net v0.50.0
@@ -10,30 +10,37 @@ import (
 
 type AnalyzeHandler struct {
 	ytdlp  *services.YtDlpService
+	tokens *DownloadTokens
 	logger *slog.Logger
 }
 
-func NewAnalyzeHandler(ytdlp *services.YtDlpService, logger *slog.Logger) *AnalyzeHandler {
+func NewAnalyzeHandler(ytdlp *services.YtDlpService, tokens *DownloadTokens, logger *slog.Logger) *AnalyzeHandler {
 	return &AnalyzeHandler{
 		ytdlp:  ytdlp,
+		tokens: tokens,
 		logger: logger,
 	}
 }
 
 type AnalyzeRequest struct {
-	URL string `json:"url"`
+	URL     string `json:"url"`
+	Refresh bool   `json:"refresh,omitempty"` // Bypass and purge the cached result
 }
 
 type AnalyzeResponse struct {
-	Platform  string            `json:"platform"`
-	Title     string            `json:"title"`
-	Duration  int               `json:"duration"`
-	Thumbnail string            `json:"thumbnail"`
-	Formats   []services.Format `json:"formats"`
+	Platform  string                   `json:"platform"`
+	Title     string                   `json:"title"`
+	Duration  int                      `json:"duration"`
+	Thumbnail string                   `json:"thumbnail"`
+	Formats   []services.Format        `json:"formats"`
+	Tags      services.Tags            `json:"tags"`
+	Chapters  []services.Chapter       `json:"chapters,omitempty"`
+	Subtitles []services.SubtitleTrack `json:"subtitles,omitempty"`
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
 }
 
 func (h *AnalyzeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -62,23 +69,15 @@ func (h *AnalyzeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	h.logger.Info("Analyzing URL", "url", req.URL)
 
+	if req.Refresh || r.Header.Get("Cache-Control") == "no-cache" {
+		// Validation errors are reported by Analyze below
+		h.ytdlp.ForgetAnalysis(req.URL)
+	}
+
 	info, err := h.ytdlp.Analyze(r.Context(), req.URL)
 	if err != nil {
 		h.logger.Error("Failed to analyze URL", "url", req.URL, "error", err)
-		
-		w.Header().Set("Content-Type", "application/json")
-		
-		switch err {
-		case services.ErrInvalidURL:
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid URL format"})
-		case services.ErrUnsupportedURL:
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(ErrorResponse{Error: "Unsupported platform. Supported: YouTube, Instagram, TikTok"})
-		default:
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to analyze video. Please check the URL and try again."})
-		}
+		writeServiceError(w, err, "Failed to analyze video. Please check the URL and try again.")
 		return
 	}
 
@@ -93,7 +92,10 @@ func (h *AnalyzeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Title:     info.Title,
 		Duration:  info.Duration,
 		Thumbnail: info.Thumbnail,
-		Formats:   simplifiedFormats,
+		Formats:   h.tokens.Issue(r, req.URL, simplifiedFormats),
+		Tags:      info.Tags,
+		Chapters:  info.Chapters,
+		Subtitles: info.Subtitles,
 	}
 
 	h.logger.Info("Analysis complete", "url", req.URL, "title", info.Title, "formats", len(response.Formats))
@@ -3,22 +3,28 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
+	"sort"
 
 	"viddown/config"
+	"viddown/services"
 )
 
 type ConfigHandler struct {
-	cfg *config.Config
+	cfg     *config.Config
+	presets []services.Preset
 }
 
-func NewConfigHandler(cfg *config.Config) *ConfigHandler {
-	return &ConfigHandler{cfg: cfg}
+func NewConfigHandler(cfg *config.Config, presets []services.Preset) *ConfigHandler {
+	return &ConfigHandler{cfg: cfg, presets: presets}
 }
 
 type ConfigResponse struct {
-	AuthRequired  bool     `json:"authRequired"`
-	MaxConcurrent int      `json:"maxConcurrent"`
-	Platforms     []string `json:"platforms"`
+	AuthRequired  bool              `json:"authRequired"`
+	MaxConcurrent int               `json:"maxConcurrent"`
+	Platforms     []string          `json:"platforms"`
+	AudioFormats  []string          `json:"audioFormats"`
+	Presets       []services.Preset `json:"presets"`
+	LoginURL      string            `json:"loginUrl,omitempty"` // Set when the UI signs in with OIDC
 }
 
 func (h *ConfigHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -26,7 +32,15 @@ func (h *ConfigHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		AuthRequired:  h.cfg.AuthRequired,
 		MaxConcurrent: h.cfg.MaxConcurrent,
 		Platforms:     []string{"youtube", "instagram", "tiktok"},
+		Presets:       h.presets,
 	}
+	if h.cfg.AuthProvider == "oidc" {
+		response.LoginURL = "/api/auth/login"
+	}
+	for name := range services.AudioFormats {
+		response.AudioFormats = append(response.AudioFormats, name)
+	}
+	sort.Strings(response.AudioFormats)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
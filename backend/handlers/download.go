@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -10,24 +12,41 @@ import (
 	"strings"
 	"time"
 
-	"golang.org/x/net/proxy"
-
+	"viddown/config"
+	"viddown/middleware"
 	"viddown/services"
 )
 
+// Strategies for delivering merged formats
+const (
+	MergeStrategyFile = "file" // Merge into a temp file, then serve it with range support
+	MergeStrategyFMP4 = "fmp4" // Merge on the fly into fragmented MP4
+)
+
 type DownloadHandler struct {
-	ytdlp     *services.YtDlpService
-	semaphore *services.Semaphore
-	logger    *slog.Logger
-	proxyURL  string
+	ytdlp         *services.YtDlpService
+	queue         *services.AdmissionQueue
+	tokens        *DownloadTokens
+	positions     *QueuePositions
+	logger        *slog.Logger
+	client        *http.Client
+	chunked       *services.ChunkedFetcher
+	mergeStrategy string
+	maxRetries    int
 }
 
-func NewDownloadHandler(ytdlp *services.YtDlpService, semaphore *services.Semaphore, logger *slog.Logger, proxyURL string) *DownloadHandler {
+func NewDownloadHandler(ytdlp *services.YtDlpService, queue *services.AdmissionQueue, tokens *DownloadTokens, positions *QueuePositions, logger *slog.Logger, cfg *config.Config) *DownloadHandler {
+	client := services.NewHTTPClient(cfg.ProxyURL)
 	return &DownloadHandler{
-		ytdlp:     ytdlp,
-		semaphore: semaphore,
-		logger:    logger,
-		proxyURL:  proxyURL,
+		ytdlp:         ytdlp,
+		queue:         queue,
+		tokens:        tokens,
+		positions:     positions,
+		logger:        logger,
+		client:        client,
+		chunked:       services.NewChunkedFetcher(client, cfg.DownloadConnections, cfg.DownloadChunkSizeMB<<20, cfg.DownloadMaxRetries),
+		mergeStrategy: cfg.MergeStrategy,
+		maxRetries:    cfg.DownloadMaxRetries,
 	}
 }
 
@@ -37,34 +56,67 @@ func (h *DownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	videoURL := r.URL.Query().Get("url")
-	formatID := r.URL.Query().Get("format_id")
-	formatType := r.URL.Query().Get("type")
+	var decodedURL, formatID, formatType string
+	if token := r.URL.Query().Get("token"); h.tokens.Accepts(token) {
+		// Legacy mode: the client names the video and format itself
+		videoURL := r.URL.Query().Get("url")
+		formatID = r.URL.Query().Get("format_id")
+		formatType = r.URL.Query().Get("type")
 
-	if videoURL == "" {
-		http.Error(w, `{"error": "URL parameter is required"}`, http.StatusBadRequest)
-		return
+		if videoURL == "" {
+			http.Error(w, `{"error": "URL parameter is required"}`, http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		decodedURL, err = url.QueryUnescape(videoURL)
+		if err != nil {
+			h.logger.Error("Failed to decode URL", "error", err)
+			http.Error(w, `{"error": "Invalid URL encoding"}`, http.StatusBadRequest)
+			return
+		}
+
+		if formatID == "" {
+			formatID = "best"
+		}
+	} else {
+		claims, err := h.tokens.Verify(r, token)
+		if err != nil {
+			h.logger.Warn("Download token rejected", "error", err, "client", middleware.ClientIP(r))
+			writeServiceError(w, err, "Invalid download link")
+			return
+		}
+		decodedURL, formatID, formatType = claims.URL, claims.FormatID, claims.Type
 	}
 
-	decodedURL, err := url.QueryUnescape(videoURL)
+	params, err := downloadParamsFromQuery(r.URL.Query())
 	if err != nil {
-		h.logger.Error("Failed to decode URL", "error", err)
-		http.Error(w, `{"error": "Invalid URL encoding"}`, http.StatusBadRequest)
+		writeServiceError(w, err, "Invalid download options")
 		return
 	}
-
-	if formatID == "" {
-		formatID = "best"
+	opts, err := params.Options(decodedURL)
+	if err != nil {
+		writeServiceError(w, err, "Invalid download options")
+		return
 	}
 
-	if !h.semaphore.TryAcquire() {
-		h.logger.Warn("Server busy, all download slots occupied")
+	// Wait for a download slot; a client that disconnects leaves the queue
+	onPosition, leftQueue := h.positions.track(r.URL.Query().Get("queue_ticket"))
+	release, err := h.queue.Acquire(r.Context(), middleware.ClientIP(r), onPosition)
+	leftQueue()
+	if err != nil {
+		if r.Context().Err() != nil {
+			h.logger.Info("Client left the download queue", "url", decodedURL)
+			return
+		}
+		h.logger.Warn("Server busy, download not admitted", "error", err)
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "60")
 		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Write([]byte(`{"error": "Сервер занят. Попробуйте позже."}`))
 		return
 	}
-	defer h.semaphore.Release()
+	defer release()
 
 	ctx := r.Context()
 	startTime := time.Now()
@@ -72,79 +124,63 @@ func (h *DownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Check if this is a merged format (contains +)
 	isMergedFormat := strings.Contains(formatID, "+")
 	isAudioOnly := formatType == "audio"
+	if isMergedFormat && opts.Convert == services.ConvertRemux {
+		// Merging writes mp4 anyway
+		opts.Convert = ""
+	}
 
-	h.logger.Info("Starting download", "url", decodedURL, "format", formatID, "merged", isMergedFormat)
+	h.logger.Info("Starting download", "url", decodedURL, "format", formatID, "merged", isMergedFormat, "audioFormat", opts.AudioFormat)
 
-	if isMergedFormat {
+	if opts.NeedsProcessing() {
+		// Converted output only exists after yt-dlp/ffmpeg ran
+		h.streamFile(w, r, decodedURL, formatID, opts, isAudioOnly, startTime)
+	} else if isMergedFormat {
 		// For merged formats, stream through yt-dlp/ffmpeg
 		h.streamMerged(w, r, ctx, decodedURL, formatID, isAudioOnly, startTime)
 	} else {
 		// For single formats, proxy stream directly from source
-		h.streamDirect(w, r, ctx, decodedURL, formatID, startTime)
+		h.streamDirect(w, r, ctx, decodedURL, formatID, isAudioOnly, startTime)
 	}
 }
 
 // streamDirect proxies the video directly from YouTube's CDN
-func (h *DownloadHandler) streamDirect(w http.ResponseWriter, r *http.Request, ctx interface{}, videoURL, formatID string, startTime time.Time) {
+func (h *DownloadHandler) streamDirect(w http.ResponseWriter, r *http.Request, ctx interface{}, videoURL, formatID string, isAudioOnly bool, startTime time.Time) {
 	// Get direct URL
 	streamInfo, err := h.ytdlp.GetDirectURL(r.Context(), videoURL, formatID)
 	if err != nil {
 		h.logger.Error("Failed to get direct URL", "url", videoURL, "error", err)
-		http.Error(w, `{"error": "Failed to get download URL"}`, http.StatusInternalServerError)
+		writeServiceError(w, err, "Failed to get download URL")
 		return
 	}
+	streamInfo.ContentType = downloadContentType(streamInfo.Filename, isAudioOnly)
 
 	h.logger.Info("Got direct URL", "filename", streamInfo.Filename)
 
-	// Create HTTP client with proxy support
-	transport := &http.Transport{}
-
-	if h.proxyURL != "" {
-		proxyParsed, err := url.Parse(h.proxyURL)
-		if err == nil && (proxyParsed.Scheme == "socks5" || proxyParsed.Scheme == "socks5h") {
-			// SOCKS5 proxy
-			auth := &proxy.Auth{}
-			if proxyParsed.User != nil {
-				auth.User = proxyParsed.User.Username()
-				auth.Password, _ = proxyParsed.User.Password()
-			}
-			dialer, err := proxy.SOCKS5("tcp", proxyParsed.Host, auth, proxy.Direct)
-			if err == nil {
-				transport.Dial = dialer.Dial
-			}
-		} else if proxyParsed.Scheme == "http" || proxyParsed.Scheme == "https" {
-			// HTTP proxy
-			transport.Proxy = http.ProxyURL(proxyParsed)
-		}
-	}
-
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   0, // No timeout for streaming
+	// Copy range header if present (for resume support). Dropped CDN
+	// connections are resumed from the last delivered byte, refreshing the
+	// signed URL if it expired.
+	refresh := func(ctx context.Context) (*services.StreamInfo, error) {
+		h.logger.Info("Refreshing expired direct URL", "url", videoURL)
+		return h.ytdlp.RefreshDirectURL(ctx, videoURL, formatID)
 	}
 
-	req, err := http.NewRequestWithContext(r.Context(), "GET", streamInfo.URL, nil)
-	if err != nil {
-		h.logger.Error("Failed to create request", "error", err)
-		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+	// Large files are fetched over several connections in parallel
+	if h.chunked.Enabled() && h.streamChunked(w, r, streamInfo, refresh, startTime) {
 		return
 	}
 
-	// Copy range header if present (for resume support)
-	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
-		req.Header.Set("Range", rangeHeader)
-	}
-
-	// Set user agent
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
-
-	resp, err := client.Do(req)
+	body, err := services.OpenResumable(r.Context(), h.client, streamInfo, r.Header.Get("Range"), refresh, h.maxRetries)
 	if err != nil {
 		h.logger.Error("Failed to fetch from source", "error", err)
+		if errors.Is(err, services.ErrRangeNotSatisfiable) {
+			writeRangeNotSatisfiable(w, err)
+			return
+		}
 		http.Error(w, `{"error": "Failed to download"}`, http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
+	defer body.Close()
+	resp := body.Response()
 
 	// Set response headers
 	sanitizedFilename := sanitizeFilename(streamInfo.Filename)
@@ -165,65 +201,190 @@ func (h *DownloadHandler) streamDirect(w http.ResponseWriter, r *http.Request, c
 	}
 
 	// Stream directly to client
-	written, err := io.Copy(w, resp.Body)
+	written, err := io.Copy(w, body)
 	if err != nil {
-		h.logger.Error("Stream interrupted", "error", err, "written", written)
+		h.logger.Error("Stream interrupted", "error", err, "written", written, "reconnects", body.Retries())
 		return
 	}
 
-	h.logger.Info("Download complete (direct)", "filename", streamInfo.Filename, "size", written, "duration", time.Since(startTime))
+	h.logger.Info("Download complete (direct)", "filename", streamInfo.Filename, "size", written, "reconnects", body.Retries(), "duration", time.Since(startTime))
+}
+
+// streamChunked fetches the stream in parallel chunks. It returns false when
+// nothing was sent and the caller should fall back to a single connection.
+func (h *DownloadHandler) streamChunked(w http.ResponseWriter, r *http.Request, streamInfo *services.StreamInfo, refresh services.RefreshFunc, startTime time.Time) bool {
+	stream, err := h.chunked.Open(r.Context(), streamInfo, r.Header.Get("Range"), refresh)
+	if err != nil {
+		if errors.Is(err, services.ErrRangeNotSatisfiable) {
+			writeRangeNotSatisfiable(w, err)
+			return true
+		}
+		if !errors.Is(err, services.ErrChunkingUnsupported) {
+			h.logger.Warn("Failed to open chunked stream, falling back to single connection", "error", err)
+		}
+		return false
+	}
+
+	sanitizedFilename := sanitizeFilename(streamInfo.Filename)
+	encodedFilename := url.PathEscape(streamInfo.Filename)
+
+	w.Header().Set("Content-Type", streamInfo.ContentType)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", stream.Length()))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, sanitizedFilename, encodedFilename))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("Range") != "" {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", stream.Start, stream.End, stream.Total))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+
+	written, err := stream.WriteTo(r.Context(), w)
+	if err != nil {
+		h.logger.Error("Chunked stream interrupted", "error", err, "written", written)
+		return true
+	}
+
+	h.logger.Info("Download complete (chunked)", "filename", streamInfo.Filename, "size", written, "duration", time.Since(startTime))
+	return true
+}
+
+// writeRangeNotSatisfiable answers a range outside the stream, naming the
+// stream size in Content-Range as RFC 9110 requires when it is known
+func writeRangeNotSatisfiable(w http.ResponseWriter, err error) {
+	var rangeErr *services.RangeError
+	if errors.As(err, &rangeErr) && rangeErr.Total >= 0 {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", rangeErr.Total))
+	}
+	http.Error(w, `{"error": "Requested range not satisfiable"}`, http.StatusRequestedRangeNotSatisfiable)
 }
 
-// streamMerged downloads merged video+audio to temp file then streams to client (original strategy)
+// streamMerged delivers merged video+audio. Fragmented MP4 streaming is used
+// when enabled, unless the client asked for a range or the temp-file strategy
+// (strategy=file), or the file is already cached; the temp-file strategy is
+// also the fallback when streaming fails before any byte was sent.
 func (h *DownloadHandler) streamMerged(w http.ResponseWriter, r *http.Request, ctx interface{}, videoURL, formatID string, isAudioOnly bool, startTime time.Time) {
-	h.logger.Info("Downloading merged video", "formatID", formatID)
+	strategy := h.mergeStrategy
+	if s := r.URL.Query().Get("strategy"); s != "" {
+		strategy = s
+	}
+	useFragmented := strategy == MergeStrategyFMP4 &&
+		r.Header.Get("Range") == "" &&
+		!h.ytdlp.IsCached(videoURL, formatID, services.DownloadOptions{})
+
+	if useFragmented && h.streamFragmented(w, r, videoURL, formatID, startTime) {
+		return
+	}
+
+	h.streamFile(w, r, videoURL, formatID, services.DownloadOptions{}, isAudioOnly, startTime)
+}
+
+// streamFragmented merges on the fly into fragmented MP4. It returns false
+// when nothing was sent and the caller should fall back to the temp file.
+func (h *DownloadHandler) streamFragmented(w http.ResponseWriter, r *http.Request, videoURL, formatID string, startTime time.Time) bool {
+	h.logger.Info("Streaming merged video as fragmented MP4", "formatID", formatID)
+
+	stream, err := h.ytdlp.OpenMergedStream(r.Context(), videoURL, formatID)
+	if err != nil {
+		if services.ErrorCode(err) != "" {
+			// Retrying with the temp file would hit the same error
+			h.logger.Error("Failed to get stream URLs", "error", err)
+			writeServiceError(w, err, "Download failed")
+			return true
+		}
+		h.logger.Warn("Failed to open merged stream, falling back to temp file", "error", err)
+		return false
+	}
+
+	sanitizedFilename := sanitizeFilename(stream.Filename)
+	encodedFilename := url.PathEscape(stream.Filename)
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, sanitizedFilename, encodedFilename))
+	w.Header().Set("Cache-Control", "no-cache")
 
-	tempPath, filename, cleanup, err := h.ytdlp.DownloadMergedToFile(r.Context(), videoURL, formatID)
+	written, err := stream.WriteTo(r.Context(), w)
 	if err != nil {
-		h.logger.Error("Merged download failed", "error", err)
-		http.Error(w, `{"error": "Download failed"}`, http.StatusInternalServerError)
+		if written == 0 && r.Context().Err() == nil {
+			h.logger.Warn("Fragmented streaming failed, falling back to temp file", "error", err)
+			w.Header().Del("Content-Disposition")
+			return false
+		}
+		h.logger.Error("Stream interrupted", "error", err, "written", written)
+		return true
+	}
+
+	h.logger.Info("Download complete (fragmented)", "filename", stream.Filename, "size", written, "duration", time.Since(startTime))
+	return true
+}
+
+// streamFile downloads (merging and converting as needed) to a temp file,
+// then streams it to the client (original strategy)
+func (h *DownloadHandler) streamFile(w http.ResponseWriter, r *http.Request, videoURL, formatID string, opts services.DownloadOptions, isAudioOnly bool, startTime time.Time) {
+	h.logger.Info("Downloading to file", "formatID", formatID, "audioFormat", opts.AudioFormat)
+
+	tempPath, filename, key, cleanup, err := h.ytdlp.DownloadToFile(r.Context(), videoURL, formatID, opts, nil)
+	if err != nil {
+		h.logger.Error("Download to file failed", "error", err)
+		writeServiceError(w, err, "Download failed")
 		return
 	}
 	defer cleanup()
 
-	file, err := os.Open(tempPath)
-	if err != nil {
+	if err := serveFile(w, r, tempPath, key, filename, downloadContentType(filename, isAudioOnly)); err != nil {
 		h.logger.Error("Failed to open temp file", "error", err)
 		http.Error(w, `{"error": "Stream failed"}`, http.StatusInternalServerError)
 		return
 	}
+
+	h.logger.Info("Download complete (file)", "filename", filename, "range", r.Header.Get("Range"), "duration", time.Since(startTime))
+}
+
+// audioContentTypes are the audio types of video containers
+var audioContentTypes = map[string]string{
+	"video/mp4":        "audio/mp4",
+	"video/webm":       "audio/webm",
+	"video/x-matroska": "audio/x-matroska",
+}
+
+// downloadContentType is the content type of a download; audio-only formats
+// in a video container get the container's audio type
+func downloadContentType(filename string, isAudioOnly bool) string {
+	contentType := services.ContentTypeFor(filename)
+	if audio, ok := audioContentTypes[contentType]; ok && isAudioOnly {
+		return audio
+	}
+	return contentType
+}
+
+// serveFile sends a finished download. Range (single and multi-range),
+// If-Range and conditional requests are handled by http.ServeContent using
+// the ETag and Last-Modified validators set here, so clients can resume and
+// seek. The ETag is built from key, the output key of the download, and the
+// size: without the file cache every request downloads a new temp file, but
+// the same URL, format and options still make the same output.
+// It only returns an error when the file can't be opened.
+func serveFile(w http.ResponseWriter, r *http.Request, path, key, filename, contentType string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
 
 	stat, err := file.Stat()
 	if err != nil {
-		h.logger.Error("Failed to stat temp file", "error", err)
-		http.Error(w, `{"error": "Stream failed"}`, http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	sanitizedFilename := sanitizeFilename(filename)
 	encodedFilename := url.PathEscape(filename)
 
-	contentType := "video/mp4"
-	if isAudioOnly {
-		contentType = "audio/mp4"
-	}
-
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
 	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, sanitizedFilename, encodedFilename))
-	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%x"`, key, stat.Size()))
 	w.Header().Set("Cache-Control", "no-cache")
 
-	h.logger.Info("Streaming to client", "filename", filename, "size", stat.Size())
-
-	written, err := io.Copy(w, file)
-	if err != nil {
-		h.logger.Error("Stream interrupted", "error", err, "written", written)
-		return
-	}
-
-	h.logger.Info("Download complete (merged)", "filename", filename, "size", written, "duration", time.Since(startTime))
+	http.ServeContent(w, r, filename, stat.ModTime(), file)
+	return nil
 }
 
 func sanitizeFilename(filename string) string {
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"viddown/services"
+)
+
+func TestDownloadContentType(t *testing.T) {
+	tests := []struct {
+		filename    string
+		isAudioOnly bool
+		want        string
+	}{
+		{"clip.mp4", false, "video/mp4"},
+		{"clip.mp4", true, "audio/mp4"},
+		{"clip.webm", false, "video/webm"},
+		{"clip.webm", true, "audio/webm"},
+		{"clip.mkv", true, "audio/x-matroska"},
+		{"song.m4a", true, "audio/mp4"},
+		{"song.opus", true, "audio/ogg"},
+		{"song.mp3", false, "audio/mpeg"},
+	}
+	for _, tt := range tests {
+		if got := downloadContentType(tt.filename, tt.isAudioOnly); got != tt.want {
+			t.Errorf("downloadContentType(%q, %v) = %q, want %q", tt.filename, tt.isAudioOnly, got, tt.want)
+		}
+	}
+}
+
+func TestWriteRangeNotSatisfiable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&services.RangeError{Total: 1000}, "bytes */1000"},
+		{&services.RangeError{Total: -1}, ""},
+		{services.ErrRangeNotSatisfiable, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeRangeNotSatisfiable(w, tt.err)
+		if w.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Fatalf("status = %d, want 416", w.Code)
+		}
+		if got := w.Header().Get("Content-Range"); got != tt.want {
+			t.Errorf("Content-Range for %v = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestServeFileResumesNewDownload(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	// Without the file cache, each request downloads to a new temp file
+	download := func() string {
+		path := filepath.Join(t.TempDir(), "video.mp4")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	first := httptest.NewRecorder()
+	if err := serveFile(first, httptest.NewRequest("GET", "/", nil), download(), "key", "video.mp4", "video/mp4"); err != nil {
+		t.Fatal(err)
+	}
+	etag := first.Header().Get("ETag")
+
+	time.Sleep(10 * time.Millisecond)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Range", "bytes=10-")
+	req.Header.Set("If-Range", etag)
+	resumed := httptest.NewRecorder()
+	if err := serveFile(resumed, req, download(), "key", "video.mp4", "video/mp4"); err != nil {
+		t.Fatal(err)
+	}
+
+	if resumed.Code != http.StatusPartialContent || resumed.Body.String() != string(data[10:]) {
+		t.Fatalf("resume = %d %q, want 206 %q", resumed.Code, resumed.Body.String(), data[10:])
+	}
+	if got := resumed.Header().Get("ETag"); got != etag {
+		t.Fatalf("ETag changed from %s to %s", etag, got)
+	}
+}
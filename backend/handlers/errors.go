@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"viddown/services"
+)
+
+// serviceErrors maps errors returned by services to HTTP responses
+var serviceErrors = []struct {
+	err     error
+	status  int
+	message string
+}{
+	{services.ErrInvalidURL, http.StatusBadRequest, "Invalid URL format"},
+	{services.ErrUnsupportedURL, http.StatusBadRequest, "Unsupported platform. Supported: YouTube, Instagram, TikTok"},
+	{services.ErrInvalidOptions, http.StatusBadRequest, "Invalid download options"},
+	{services.ErrInvalidToken, http.StatusForbidden, "Invalid download link. Please analyze the video again."},
+	{services.ErrTokenExpired, http.StatusForbidden, "Download link has expired. Please analyze the video again."},
+	{services.ErrVideoUnavailable, http.StatusNotFound, "Video is unavailable or has been removed"},
+	{services.ErrPrivateVideo, http.StatusForbidden, "Video is private"},
+	{services.ErrLoginRequired, http.StatusForbidden, "Video requires sign-in (age-restricted or login required)"},
+	{services.ErrGeoBlocked, http.StatusUnavailableForLegalReasons, "Video is not available in the server's region"},
+	{services.ErrMembersOnly, http.StatusForbidden, "Video is available to channel members only"},
+	{services.ErrLiveNotStarted, http.StatusConflict, "Live stream has not started yet"},
+	{services.ErrRateLimited, http.StatusServiceUnavailable, "The platform is rate-limiting the server. Please try again later."},
+}
+
+// writeServiceError writes err as a JSON error response with a status and
+// code clients can act on. Unrecognized errors become a 500 with the fallback
+// message.
+func writeServiceError(w http.ResponseWriter, err error, fallback string) {
+	status, message := http.StatusInternalServerError, fallback
+	for _, e := range serviceErrors {
+		if errors.Is(err, e.err) {
+			status, message = e.status, e.message
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "300")
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: message, Code: services.ErrorCode(err)})
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"viddown/middleware"
+	"viddown/services"
+)
+
+type JobsHandler struct {
+	jobs   *services.JobManager
+	tokens *DownloadTokens
+	logger *slog.Logger
+}
+
+func NewJobsHandler(jobs *services.JobManager, tokens *DownloadTokens, logger *slog.Logger) *JobsHandler {
+	return &JobsHandler{
+		jobs:   jobs,
+		tokens: tokens,
+		logger: logger,
+	}
+}
+
+// CreateJobRequest names the format with the token from /api/analyze, or
+// with url, format_id and type in legacy mode
+type CreateJobRequest struct {
+	Token    string `json:"token,omitempty"`
+	URL      string `json:"url"`
+	FormatID string `json:"format_id"`
+	Type     string `json:"type"`
+	DownloadParams
+}
+
+// Create handles POST /api/jobs
+func (h *JobsHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req CreateJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logger.Error("Failed to decode request", "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	if !h.tokens.Accepts(req.Token) {
+		claims, err := h.tokens.Verify(r, req.Token)
+		if err != nil {
+			writeServiceError(w, err, "Invalid download link")
+			return
+		}
+		req.URL, req.FormatID, req.Type = claims.URL, claims.FormatID, claims.Type
+	}
+
+	if req.URL == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "URL is required"})
+		return
+	}
+
+	opts, err := req.Options(req.URL)
+	if err != nil {
+		writeServiceError(w, err, "Invalid download options")
+		return
+	}
+
+	job, err := h.jobs.Create(services.JobRequest{
+		URL:      req.URL,
+		FormatID: req.FormatID,
+		Type:     req.Type,
+		Options:  opts,
+		Client:   middleware.ClientIP(r),
+	})
+	if err != nil {
+		h.logger.Error("Failed to create job", "url", req.URL, "error", err)
+		writeServiceError(w, err, "Failed to create job")
+		return
+	}
+
+	h.logger.Info("Job created", "job", job.ID, "url", job.URL, "format", job.FormatID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// Get handles GET /api/jobs/{id}
+func (h *JobsHandler) Get(w http.ResponseWriter, r *http.Request) {
+	job, err := h.jobs.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Job not found"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(job)
+}
+
+// Delete handles DELETE /api/jobs/{id}, canceling the job and leaving the
+// download queue
+func (h *JobsHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := h.jobs.Cancel(id); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Job not found"})
+		return
+	}
+
+	h.logger.Info("Job canceled", "job", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// File handles GET /api/jobs/{id}/file
+func (h *JobsHandler) File(w http.ResponseWriter, r *http.Request) {
+	path, key, job, err := h.jobs.File(chi.URLParam(r, "id"))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case errors.Is(err, services.ErrJobNotReady):
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Job is " + string(job.State)})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Job not found"})
+		}
+		return
+	}
+
+	startTime := time.Now()
+	if err := serveFile(w, r, path, key, job.Filename, downloadContentType(job.Filename, job.Type == "audio")); err != nil {
+		h.logger.Error("Failed to open job file", "job", job.ID, "error", err)
+		http.Error(w, `{"error": "File is no longer available"}`, http.StatusGone)
+		return
+	}
+
+	h.logger.Info("Job file served", "job", job.ID, "filename", job.Filename, "range", r.Header.Get("Range"), "duration", time.Since(startTime))
+}
+
+// sseKeepAlive is how often a comment is sent to keep idle proxies from
+// closing the event stream
+const sseKeepAlive = 15 * time.Second
+
+// Events handles GET /api/jobs/{id}/events, streaming job updates as
+// Server-Sent Events until the job is ready or failed
+func (h *JobsHandler) Events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, `{"error": "Streaming not supported"}`, http.StatusInternalServerError)
+		return
+	}
+
+	updates, unsubscribe, err := h.jobs.Subscribe(chi.URLParam(r, "id"))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Job not found"})
+		return
+	}
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // Disable nginx buffering
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case job := <-updates:
+			data, err := json.Marshal(job)
+			if err != nil {
+				h.logger.Error("Failed to encode job", "job", job.ID, "error", err)
+				return
+			}
+
+			event := "progress"
+			if job.Finished() {
+				event = string(job.State)
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+			flusher.Flush()
+
+			if job.Finished() {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"viddown/services"
+)
+
+// DownloadParams are the output options accepted by /api/download as query
+// parameters and by /api/jobs in the JSON body
+type DownloadParams struct {
+	AudioFormat  string `json:"audio_format,omitempty"`
+	AudioBitrate int    `json:"audio_bitrate,omitempty"`
+
+	// Tags, set on their own or overridden with the tag_* fields
+	EmbedMetadata bool   `json:"embed_metadata,omitempty"`
+	TagTitle      string `json:"tag_title,omitempty"`
+	TagArtist     string `json:"tag_artist,omitempty"`
+	TagAlbum      string `json:"tag_album,omitempty"`
+	TagDate       string `json:"tag_date,omitempty"`
+	TagTrack      int    `json:"tag_track,omitempty"`
+
+	// Clip boundaries as seconds, "1:30" or "1m30s". Start defaults to the
+	// t= parameter of the video URL.
+	Start   string `json:"start,omitempty"`
+	End     string `json:"end,omitempty"`
+	Precise bool   `json:"precise,omitempty"` // Frame-accurate, re-encoded cut
+
+	Chapter       int  `json:"chapter,omitempty"`        // Number from the analyze response
+	SplitChapters bool `json:"split_chapters,omitempty"` // All chapters as files in a zip
+
+	Subtitles    string `json:"subtitles,omitempty"`     // Comma-separated languages
+	SubtitleMode string `json:"subtitle_mode,omitempty"` // embed, srt, vtt or ass
+
+	Preset  string `json:"preset,omitempty"`  // Name from GET /api/config
+	Convert string `json:"convert,omitempty"` // remux or transcode, from the format's conversion
+}
+
+// downloadParamsFromQuery reads DownloadParams from query parameters
+func downloadParamsFromQuery(query url.Values) (DownloadParams, error) {
+	params := DownloadParams{
+		AudioFormat: query.Get("audio_format"),
+		TagTitle:    query.Get("tag_title"),
+		TagArtist:   query.Get("tag_artist"),
+		TagAlbum:    query.Get("tag_album"),
+		TagDate:     query.Get("tag_date"),
+		Start:       query.Get("start"),
+		End:         query.Get("end"),
+
+		Subtitles:    query.Get("subtitles"),
+		SubtitleMode: query.Get("subtitle_mode"),
+
+		Preset:  query.Get("preset"),
+		Convert: query.Get("convert"),
+	}
+
+	var err error
+	if params.AudioBitrate, err = queryInt(query, "audio_bitrate"); err != nil {
+		return params, err
+	}
+	if params.TagTrack, err = queryInt(query, "tag_track"); err != nil {
+		return params, err
+	}
+	if params.EmbedMetadata, err = queryBool(query, "embed_metadata"); err != nil {
+		return params, err
+	}
+	if params.Precise, err = queryBool(query, "precise"); err != nil {
+		return params, err
+	}
+	if params.Chapter, err = queryInt(query, "chapter"); err != nil {
+		return params, err
+	}
+	if params.SplitChapters, err = queryBool(query, "split_chapters"); err != nil {
+		return params, err
+	}
+
+	return params, nil
+}
+
+// queryBool parses an optional boolean query parameter
+func queryBool(query url.Values, name string) (bool, error) {
+	v := query.Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%w: invalid %s", services.ErrInvalidOptions, name)
+	}
+	return b, nil
+}
+
+// queryInt parses an optional integer query parameter
+func queryInt(query url.Values, name string) (int, error) {
+	v := query.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid %s", services.ErrInvalidOptions, name)
+	}
+	return i, nil
+}
+
+// Options validates the params and converts them to service options for
+// downloading videoURL
+func (p DownloadParams) Options(videoURL string) (services.DownloadOptions, error) {
+	opts := services.DownloadOptions{
+		AudioFormat:   p.AudioFormat,
+		AudioBitrate:  p.AudioBitrate,
+		EmbedMetadata: p.EmbedMetadata,
+		Tags: services.Tags{
+			Title:  p.TagTitle,
+			Artist: p.TagArtist,
+			Album:  p.TagAlbum,
+			Date:   p.TagDate,
+			Track:  p.TagTrack,
+		},
+	}
+	// Overriding a tag implies writing tags
+	if !opts.Tags.IsZero() {
+		opts.EmbedMetadata = true
+	}
+
+	opts.Chapter = p.Chapter
+	opts.SplitChapters = p.SplitChapters
+	opts.Subtitles = p.Subtitles
+	opts.SubtitleMode = p.SubtitleMode
+	opts.Preset = p.Preset
+	opts.Convert = p.Convert
+
+	var err error
+	if p.Start != "" {
+		if opts.Start, err = services.ParseTimestamp(p.Start); err != nil {
+			return opts, fmt.Errorf("%w: invalid start: %v", services.ErrInvalidOptions, err)
+		}
+	} else if p.Chapter == 0 && !p.SplitChapters && !opts.SubtitlesOnly() {
+		opts.Start = services.StartFromURL(videoURL)
+	}
+	if p.End != "" {
+		if opts.End, err = services.ParseTimestamp(p.End); err != nil {
+			return opts, fmt.Errorf("%w: invalid end: %v", services.ErrInvalidOptions, err)
+		}
+	}
+	opts.PreciseCut = p.Precise
+
+	return opts, opts.Validate()
+}
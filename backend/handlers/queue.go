@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+
+	"viddown/services"
+)
+
+var queueTicketPattern = regexp.MustCompile(`^[\w-]{16,64}$`)
+
+// QueuePositions shows clients of /api/download their place in the download
+// queue. The download names a random ticket with queue_ticket, and the client
+// polls /api/queue/{ticket} while its request waits; jobs report their
+// position themselves.
+type QueuePositions struct {
+	mu        sync.Mutex
+	positions map[string]int
+}
+
+func NewQueuePositions() *QueuePositions {
+	return &QueuePositions{positions: make(map[string]int)}
+}
+
+// track returns the position callback for a waiting request and a func to
+// call once it left the queue. Invalid tickets aren't tracked.
+func (q *QueuePositions) track(ticket string) (onPosition services.PositionFunc, done func()) {
+	if !queueTicketPattern.MatchString(ticket) {
+		return nil, func() {}
+	}
+	onPosition = func(position int) {
+		q.mu.Lock()
+		q.positions[ticket] = position
+		q.mu.Unlock()
+	}
+	done = func() {
+		q.mu.Lock()
+		delete(q.positions, ticket)
+		q.mu.Unlock()
+	}
+	return onPosition, done
+}
+
+// QueuePositionResponse is the place in the queue; 0 when not waiting
+type QueuePositionResponse struct {
+	Position int `json:"position"`
+}
+
+// ServeHTTP handles GET /api/queue/{ticket}
+func (q *QueuePositions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q.mu.Lock()
+	position := q.positions[chi.URLParam(r, "ticket")]
+	q.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(QueuePositionResponse{Position: position})
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func queuePosition(t *testing.T, q *QueuePositions, ticket string) int {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/queue/"+ticket, nil)
+	routeCtx := chi.NewRouteContext()
+	routeCtx.URLParams.Add("ticket", ticket)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, routeCtx))
+
+	w := httptest.NewRecorder()
+	q.ServeHTTP(w, r)
+	var resp QueuePositionResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Position
+}
+
+func TestQueuePositions(t *testing.T) {
+	q := NewQueuePositions()
+	ticket := "0123456789abcdef0123"
+
+	onPosition, done := q.track(ticket)
+	onPosition(3)
+	if got := queuePosition(t, q, ticket); got != 3 {
+		t.Fatalf("position = %d, want 3", got)
+	}
+	onPosition(1)
+	if got := queuePosition(t, q, ticket); got != 1 {
+		t.Fatalf("position = %d, want 1", got)
+	}
+	done()
+	if got := queuePosition(t, q, ticket); got != 0 {
+		t.Fatalf("position after leaving = %d, want 0", got)
+	}
+}
+
+func TestQueuePositionsIgnoresInvalidTickets(t *testing.T) {
+	q := NewQueuePositions()
+	for _, ticket := range []string{"", "short", "has spaces in the ticket!", string(make([]byte, 80))} {
+		if onPosition, _ := q.track(ticket); onPosition != nil {
+			t.Fatalf("ticket %q was tracked", ticket)
+		}
+	}
+}
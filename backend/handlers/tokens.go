@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"net/http"
+
+	"viddown/middleware"
+	"viddown/services"
+)
+
+// DownloadTokens issues tokens for the formats returned by /api/analyze and
+// checks them on /api/download and /api/jobs, so only analyzed formats can
+// be downloaded, by the client they were offered to
+type DownloadTokens struct {
+	signer *services.TokenSigner
+	legacy bool // Also accept url and format_id without a token
+}
+
+func NewDownloadTokens(signer *services.TokenSigner, legacy bool) *DownloadTokens {
+	return &DownloadTokens{
+		signer: signer,
+		legacy: legacy,
+	}
+}
+
+// Issue returns a copy of formats with a token set on each. formats may be
+// shared with the analyze cache, so it isn't modified.
+func (t *DownloadTokens) Issue(r *http.Request, videoURL string, formats []services.Format) []services.Format {
+	signed := make([]services.Format, len(formats))
+	copy(signed, formats)
+
+	client := clientIdentity(r)
+	for i := range signed {
+		signed[i].Token = t.signer.Sign(services.DownloadClaims{
+			URL:      videoURL,
+			FormatID: signed[i].ID,
+			Type:     signed[i].Type,
+			Client:   client,
+		})
+	}
+	return signed
+}
+
+// Accepts reports whether a request without a token may name the url and
+// format itself
+func (t *DownloadTokens) Accepts(token string) bool {
+	return token == "" && t.legacy
+}
+
+// Verify checks token and that it was issued to the requesting client
+func (t *DownloadTokens) Verify(r *http.Request, token string) (*services.DownloadClaims, error) {
+	if token == "" {
+		return nil, services.ErrInvalidToken
+	}
+	claims, err := t.signer.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Client != clientIdentity(r) {
+		return nil, services.ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// clientIdentity is the authenticated user, or the client IP without auth
+func clientIdentity(r *http.Request) string {
+	if user, ok := r.Context().Value(middleware.UserContextKey).(*middleware.User); ok && user != nil && user.ID != "" {
+		return "user:" + user.ID
+	}
+	return "ip:" + middleware.ClientIP(r)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
@@ -32,29 +34,73 @@ func main() {
 		"port", cfg.Port,
 		"authRequired", cfg.AuthRequired,
 		"maxConcurrent", cfg.MaxConcurrent,
+		"maxPerClient", cfg.MaxPerClient,
+		"queueMaxDepth", cfg.QueueMaxDepth,
 		"rateLimitRPM", cfg.RateLimitRPM,
 		"proxyConfigured", cfg.ProxyURL != "",
+		"cacheMaxSizeMB", cfg.CacheMaxSizeMB,
+		"mergeStrategy", cfg.MergeStrategy,
+		"downloadConnections", cfg.DownloadConnections,
+		"resolutions", cfg.Resolutions,
+		"downloadLegacyLinks", cfg.DownloadLegacyLinks,
+		"authProvider", cfg.AuthProvider,
 	)
 
 	// Initialize services
 	validator := services.NewValidator()
-	ytdlp := services.NewYtDlpService(cfg.YtDlpPath, cfg.CookiesFile, cfg.ProxyURL, validator)
-	semaphore := services.NewSemaphore(cfg.MaxConcurrent)
+	analyzeCache := services.NewAnalyzeCache(cfg.AnalyzeCacheTTL, cfg.AnalyzeCacheSize)
+	fileCache := services.NewFileCache(cfg.CacheDir, cfg.CacheMaxSizeMB<<20, cfg.CacheTTL, logger)
+	presets, err := services.LoadPresets(cfg.PresetsFile)
+	if err != nil {
+		logger.Error("Failed to load presets, using defaults", "error", err)
+		presets = services.DefaultPresets
+	}
+	ytdlp := services.NewYtDlpService(cfg.YtDlpPath, cfg.FFmpegPath, cfg.CookiesFile, cfg.ProxyURL, validator, analyzeCache, fileCache, cfg.Resolutions, presets)
+	queue := services.NewAdmissionQueue(cfg.MaxConcurrent, cfg.MaxPerClient, cfg.QueueMaxDepth, cfg.QueueMaxWait)
 	rateLimiter := middleware.NewRateLimiter(cfg.RateLimitRPM)
+	jobManager := services.NewJobManager(ytdlp, queue, logger, cfg.JobTTL)
+
+	tokenKeys, err := services.ParseSigningKeys(cfg.DownloadTokenKeys)
+	if err != nil {
+		logger.Error("Invalid DOWNLOAD_TOKEN_KEYS", "error", err)
+		os.Exit(1)
+	}
+	if len(tokenKeys) == 0 {
+		logger.Warn("DOWNLOAD_TOKEN_KEYS not set, download links won't survive a restart")
+	}
+	tokenSigner, err := services.NewTokenSigner(tokenKeys, cfg.DownloadTokenTTL)
+	if err != nil {
+		logger.Error("Failed to create download token signer", "error", err)
+		os.Exit(1)
+	}
+	downloadTokens := handlers.NewDownloadTokens(tokenSigner, cfg.DownloadLegacyLinks)
 
 	// Initialize handlers
 	healthHandler := handlers.NewHealthHandler(cfg.YtDlpPath)
-	configHandler := handlers.NewConfigHandler(cfg)
-	analyzeHandler := handlers.NewAnalyzeHandler(ytdlp, logger)
-	downloadHandler := handlers.NewDownloadHandler(ytdlp, semaphore, logger, cfg.ProxyURL)
-	thumbnailHandler := handlers.NewThumbnailHandler(logger)
+	configHandler := handlers.NewConfigHandler(cfg, ytdlp.Presets())
+	analyzeHandler := handlers.NewAnalyzeHandler(ytdlp, downloadTokens, logger)
+	queuePositions := handlers.NewQueuePositions()
+	downloadHandler := handlers.NewDownloadHandler(ytdlp, queue, downloadTokens, queuePositions, logger, cfg)
+	thumbnailHosts := cfg.ThumbnailHosts
+	if thumbnailHosts == nil {
+		thumbnailHosts = services.DefaultThumbnailHosts
+	}
+	thumbnailFetcher := services.NewThumbnailFetcher(thumbnailHosts, int64(cfg.ThumbnailMaxSizeKB)<<10)
+	thumbnailHandler := handlers.NewThumbnailHandler(thumbnailFetcher, logger)
+	jobsHandler := handlers.NewJobsHandler(jobManager, downloadTokens, logger)
+
+	trustedProxies, err := middleware.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		logger.Error("Invalid TRUSTED_PROXIES", "error", err)
+		os.Exit(1)
+	}
 
 	// Initialize router
 	r := chi.NewRouter()
 
 	// Global middleware
 	r.Use(chimiddleware.RequestID)
-	r.Use(chimiddleware.RealIP)
+	r.Use(middleware.RealIP(trustedProxies))
 	r.Use(chimiddleware.Logger)
 	r.Use(chimiddleware.Recoverer)
 	r.Use(chimiddleware.Timeout(6 * time.Hour)) // Extended for long videos
@@ -65,17 +111,40 @@ func main() {
 	// Rate limiting
 	r.Use(rateLimiter.Middleware)
 
-	// Auth middleware (currently a no-op when AUTH_REQUIRED=false)
-	authProvider := &middleware.NoAuthProvider{}
-	r.Use(middleware.AuthMiddleware(cfg.AuthRequired, authProvider))
+	authProvider, err := newAuthProvider(cfg, logger)
+	if err != nil {
+		logger.Error("Failed to set up authentication", "error", err)
+		os.Exit(1)
+	}
 
 	// API routes
 	r.Route("/api", func(r chi.Router) {
+		// Public, so the UI can find out it has to sign in
 		r.Get("/health", healthHandler.ServeHTTP)
 		r.Get("/config", configHandler.ServeHTTP)
-		r.Post("/analyze", analyzeHandler.ServeHTTP)
-		r.Get("/download", downloadHandler.ServeHTTP)
-		r.Get("/thumbnail", thumbnailHandler.ServeHTTP)
+
+		if oidc, ok := authProvider.(*middleware.OIDCProvider); ok {
+			r.Route("/auth", func(r chi.Router) {
+				r.Get("/login", oidc.Login)
+				r.Get("/callback", oidc.Callback)
+				r.Post("/logout", oidc.Logout)
+				r.Get("/me", oidc.Me)
+			})
+		}
+
+		// Auth middleware (a no-op when AUTH_REQUIRED=false)
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.AuthMiddleware(cfg.AuthRequired, authProvider))
+			r.Post("/analyze", analyzeHandler.ServeHTTP)
+			r.Get("/download", downloadHandler.ServeHTTP)
+			r.Get("/queue/{ticket}", queuePositions.ServeHTTP)
+			r.Get("/thumbnail", thumbnailHandler.ServeHTTP)
+			r.Post("/jobs", jobsHandler.Create)
+			r.Get("/jobs/{id}", jobsHandler.Get)
+			r.Delete("/jobs/{id}", jobsHandler.Delete)
+			r.Get("/jobs/{id}/file", jobsHandler.File)
+			r.Get("/jobs/{id}/events", jobsHandler.Events)
+		})
 	})
 
 	// Create server
@@ -114,4 +183,47 @@ func main() {
 	logger.Info("Server stopped gracefully")
 }
 
+// newAuthProvider creates the provider selected by AUTH_PROVIDER
+func newAuthProvider(cfg *config.Config, logger *slog.Logger) (middleware.AuthProvider, error) {
+	switch cfg.AuthProvider {
+	case "none", "":
+		if cfg.AuthRequired {
+			return nil, fmt.Errorf("AUTH_REQUIRED=true needs an AUTH_PROVIDER")
+		}
+		return &middleware.NoAuthProvider{}, nil
+	case "jwt":
+		return middleware.NewJWTProvider(middleware.JWTConfig{
+			HMACSecret:    cfg.JWTSecret,
+			PublicKeyFile: cfg.JWTPublicKeyFile,
+			JWKSFile:      cfg.JWTJWKSFile,
+			JWKSReload:    cfg.JWTJWKSReload,
+			Issuer:        cfg.JWTIssuer,
+			Audience:      cfg.JWTAudience,
+			ClockSkew:     cfg.JWTClockSkew,
+		}, logger)
+	case "oidc":
+		var sessionKey []byte
+		if cfg.SessionKey != "" {
+			key, err := base64.StdEncoding.DecodeString(cfg.SessionKey)
+			if err != nil || len(key) != 32 {
+				return nil, fmt.Errorf("SESSION_KEY must be 32 bytes, base64-encoded")
+			}
+			sessionKey = key
+		}
+		return middleware.NewOIDCProvider(middleware.OIDCConfig{
+			Issuer:        cfg.OIDCIssuer,
+			ClientID:      cfg.OIDCClientID,
+			ClientSecret:  cfg.OIDCClientSecret,
+			RedirectURL:   cfg.OIDCRedirectURL,
+			Scopes:        cfg.OIDCScopes,
+			PostLogoutURL: cfg.OIDCPostLogoutURL,
+			SessionKey:    sessionKey,
+			SessionTTL:    cfg.SessionTTL,
+			CookieSecure:  cfg.CookieSecure,
+			ClockSkew:     cfg.JWTClockSkew,
+		}, logger)
+	}
+	return nil, fmt.Errorf("unknown AUTH_PROVIDER %q", cfg.AuthProvider)
+}
+
 
@@ -3,20 +3,21 @@ package middleware
 import (
 	"context"
 	"net/http"
+	"strings"
 )
 
-// User represents an authenticated user (for future use)
+// User represents an authenticated user
 type User struct {
-	ID    string
-	Email string
-	Name  string
+	ID    string `json:"id"`
+	Email string `json:"email,omitempty"`
+	Name  string `json:"name,omitempty"`
 }
 
 type contextKey string
 
 const UserContextKey contextKey = "user"
 
-// AuthProvider interface for future JWT/OAuth implementations
+// AuthProvider validates a bearer token
 type AuthProvider interface {
 	Validate(token string) (*User, error)
 }
@@ -28,25 +29,10 @@ func (p *NoAuthProvider) Validate(token string) (*User, error) {
 	return nil, nil
 }
 
-// JWTProvider placeholder for future JWT implementation
-type JWTProvider struct {
-	Secret string
-}
-
-func (p *JWTProvider) Validate(token string) (*User, error) {
-	// TODO: Implement JWT validation
-	return nil, nil
-}
-
-// OAuthProvider placeholder for future OAuth implementation
-type OAuthProvider struct {
-	ClientID     string
-	ClientSecret string
-}
-
-func (p *OAuthProvider) Validate(token string) (*User, error) {
-	// TODO: Implement OAuth validation
-	return nil, nil
+// SessionProvider is implemented by providers that also sign browsers in
+// with a session cookie. The writer lets them renew the cookie.
+type SessionProvider interface {
+	SessionUser(w http.ResponseWriter, r *http.Request) (*User, error)
 }
 
 // AuthMiddleware creates authentication middleware
@@ -60,14 +46,23 @@ func AuthMiddleware(required bool, provider AuthProvider) func(next http.Handler
 				return
 			}
 
-			token := r.Header.Get("Authorization")
-			if token == "" {
-				http.Error(w, `{"error": "Authorization required"}`, http.StatusUnauthorized)
+			token, ok := bearerToken(r)
+			if !ok {
+				if sessions, isSession := provider.(SessionProvider); isSession {
+					if user, err := sessions.SessionUser(w, r); err == nil && user != nil {
+						ctx := context.WithValue(r.Context(), UserContextKey, user)
+						next.ServeHTTP(w, r.WithContext(ctx))
+						return
+					}
+				}
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, `{"error": "Authorization required", "code": "unauthenticated"}`, http.StatusUnauthorized)
 				return
 			}
 
 			user, err := provider.Validate(token)
-			if err != nil {
+			if err != nil || user == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
 				http.Error(w, `{"error": "Invalid token"}`, http.StatusUnauthorized)
 				return
 			}
@@ -78,4 +73,14 @@ func AuthMiddleware(required bool, provider AuthProvider) func(next http.Handler
 	}
 }
 
+// bearerToken returns the token of an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
 
@@ -0,0 +1,450 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidJWT = errors.New("invalid token")
+	ErrExpiredJWT = errors.New("token expired")
+)
+
+// JWTConfig configures JWTProvider. At least one of HMACSecret,
+// PublicKeyFile, JWKSFile or JWKSURL must be set.
+type JWTConfig struct {
+	HMACSecret    string        // Shared secret for HS256
+	PublicKeyFile string        // PEM RSA or EC public key for RS256/ES256
+	JWKSFile      string        // JWKS with RS256/ES256 keys, reloaded every JWKSReload
+	JWKSURL       string        // Remote JWKS, e.g. an OIDC provider's jwks_uri
+	JWKSReload    time.Duration // 0 loads the JWKS once, apart from unknown kids
+	Issuer        string        // Required iss, if set
+	Audience      string        // Required in aud, if set
+	ClockSkew     time.Duration // Leeway for exp and nbf
+}
+
+// jwksRefetchInterval limits reloads triggered by tokens with an unknown
+// kid, which is how key rotation at the issuer shows up
+const jwksRefetchInterval = time.Minute
+
+// JWTProvider validates JWTs signed with HS256, RS256 or ES256
+type JWTProvider struct {
+	cfg    JWTConfig
+	logger *slog.Logger
+
+	hmacKey   []byte
+	staticKey crypto.PublicKey // From PublicKeyFile, used for tokens without a known kid
+
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey // From the JWKS, by kid
+	lastFetch time.Time                   // Last JWKS fetch attempt
+
+	// fetchJWKS reads the JWKS; nil without one
+	fetchJWKS func() ([]byte, error)
+}
+
+func NewJWTProvider(cfg JWTConfig, logger *slog.Logger) (*JWTProvider, error) {
+	p := &JWTProvider{
+		cfg:    cfg,
+		logger: logger,
+		keys:   make(map[string]crypto.PublicKey),
+	}
+	if cfg.HMACSecret != "" {
+		if len(cfg.HMACSecret) < 32 {
+			return nil, fmt.Errorf("JWT secret must be at least 32 bytes")
+		}
+		p.hmacKey = []byte(cfg.HMACSecret)
+	}
+	if cfg.PublicKeyFile != "" {
+		key, err := loadPublicKey(cfg.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		p.staticKey = key
+	}
+	switch {
+	case cfg.JWKSFile != "":
+		p.fetchJWKS = func() ([]byte, error) {
+			return os.ReadFile(cfg.JWKSFile)
+		}
+	case cfg.JWKSURL != "":
+		p.fetchJWKS = func() ([]byte, error) {
+			return fetchURL(cfg.JWKSURL)
+		}
+	}
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// start loads the JWKS and keeps reloading it. Without any key source the
+// provider would reject every token, which is a configuration error.
+func (p *JWTProvider) start() error {
+	if p.fetchJWKS == nil {
+		if p.hmacKey == nil && p.staticKey == nil {
+			return fmt.Errorf("JWT provider needs a secret, public key or JWKS")
+		}
+		return nil
+	}
+	if err := p.reloadKeys(); err != nil {
+		return err
+	}
+	if p.cfg.JWKSReload > 0 {
+		go p.reloadLoop()
+	}
+	return nil
+}
+
+func (p *JWTProvider) reloadLoop() {
+	ticker := time.NewTicker(p.cfg.JWKSReload)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := p.reloadKeys(); err != nil {
+			// Keep the previous keys, so a bad deploy of the file doesn't lock
+			// everyone out
+			p.logger.Warn("Failed to reload JWKS, keeping previous keys", "error", err)
+		}
+	}
+}
+
+func (p *JWTProvider) reloadKeys() error {
+	p.mu.Lock()
+	p.lastFetch = time.Now()
+	p.mu.Unlock()
+
+	data, err := p.fetchJWKS()
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS: %w", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	return nil
+}
+
+// refetchKeys reloads the JWKS for a token with an unknown kid. Attempts,
+// failed ones included, happen at most once per jwksRefetchInterval, so
+// tokens with made-up kids or an unreachable issuer can't make every request
+// wait for a fetch; only the request that claims the attempt fetches.
+func (p *JWTProvider) refetchKeys() {
+	if p.fetchJWKS == nil {
+		return
+	}
+	p.mu.Lock()
+	if time.Since(p.lastFetch) < jwksRefetchInterval {
+		p.mu.Unlock()
+		return
+	}
+	p.lastFetch = time.Now()
+	p.mu.Unlock()
+
+	if err := p.reloadKeys(); err != nil {
+		p.logger.Warn("Failed to reload JWKS for unknown key", "error", err)
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject           string   `json:"sub"`
+	Email             string   `json:"email"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+	Issuer            string   `json:"iss"`
+	Audience          audience `json:"aud"`
+	Expires           *float64 `json:"exp"`
+	NotBefore         *float64 `json:"nbf"`
+	Nonce             string   `json:"nonce"`
+}
+
+// audience is the aud claim, a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// Validate verifies the token's signature and claims and returns its user
+func (p *JWTProvider) Validate(token string) (*User, error) {
+	claims, err := p.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return claims.user(), nil
+}
+
+func (c *jwtClaims) user() *User {
+	name := c.Name
+	if name == "" {
+		name = c.PreferredUsername
+	}
+	return &User{ID: c.Subject, Email: c.Email, Name: name}
+}
+
+// verify checks the signature and the time, issuer and audience claims
+func (p *JWTProvider) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidJWT
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidJWT
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidJWT
+	}
+	if err := p.verifySignature(header, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidJWT
+	}
+	if err := p.checkClaims(&claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func (p *JWTProvider) verifySignature(header jwtHeader, signed string, sig []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	if header.Alg != "HS256" && !p.hasKey(header.Kid) {
+		// The issuer may have rotated its keys
+		p.refetchKeys()
+	}
+
+	switch header.Alg {
+	case "HS256":
+		if p.hmacKey == nil {
+			return fmt.Errorf("%w: HS256 not configured", ErrInvalidJWT)
+		}
+		mac := hmac.New(sha256.New, p.hmacKey)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return ErrInvalidJWT
+		}
+		return nil
+
+	case "RS256":
+		key, ok := p.publicKey(header.Kid).(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: no RSA key %q", ErrInvalidJWT, header.Kid)
+		}
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+			return ErrInvalidJWT
+		}
+		return nil
+
+	case "ES256":
+		key, ok := p.publicKey(header.Kid).(*ecdsa.PublicKey)
+		if !ok || key.Curve != elliptic.P256() || len(sig) != 64 {
+			return fmt.Errorf("%w: no P-256 key %q", ErrInvalidJWT, header.Kid)
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return ErrInvalidJWT
+		}
+		return nil
+	}
+	// "none" and anything else
+	return fmt.Errorf("%w: unsupported alg %q", ErrInvalidJWT, header.Alg)
+}
+
+// hasKey reports whether the JWKS has kid; tokens without a kid use the
+// static key
+func (p *JWTProvider) hasKey(kid string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.keys[kid]
+	return ok || kid == ""
+}
+
+// publicKey returns the JWKS key with kid, falling back to the static key
+func (p *JWTProvider) publicKey(kid string) crypto.PublicKey {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if key, ok := p.keys[kid]; ok {
+		return key
+	}
+	if kid == "" && len(p.keys) == 1 && p.staticKey == nil {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return p.staticKey
+}
+
+func (p *JWTProvider) checkClaims(c *jwtClaims) error {
+	now := float64(time.Now().Unix())
+	skew := p.cfg.ClockSkew.Seconds()
+
+	if c.Expires == nil {
+		return fmt.Errorf("%w: missing exp", ErrInvalidJWT)
+	}
+	if now > *c.Expires+skew {
+		return ErrExpiredJWT
+	}
+	if c.NotBefore != nil && now < *c.NotBefore-skew {
+		return fmt.Errorf("%w: not valid yet", ErrInvalidJWT)
+	}
+	if p.cfg.Issuer != "" && c.Issuer != p.cfg.Issuer {
+		return fmt.Errorf("%w: unexpected issuer %q", ErrInvalidJWT, c.Issuer)
+	}
+	if p.cfg.Audience != "" && !slices.Contains(c.Audience, p.cfg.Audience) {
+		return fmt.Errorf("%w: audience mismatch", ErrInvalidJWT)
+	}
+	if c.Subject == "" {
+		return fmt.Errorf("%w: missing sub", ErrInvalidJWT)
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// loadPublicKey reads a PEM public key (PKIX or PKCS#1) or certificate
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT public key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("JWT public key is not PEM")
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q in JWT public key", block.Type)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the RSA and P-256 signing keys of a JWKS by kid
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %q: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+// publicKey decodes the key, or returns nil for unsupported key types
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.E < 3 || key.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key too weak")
+		}
+		return key, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("invalid P-256 coordinates")
+		}
+		// ecdh rejects points that aren't on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, nil
+}
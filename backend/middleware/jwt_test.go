@@ -0,0 +1,247 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHMACSecret = "0123456789abcdef0123456789abcdef"
+
+type jwtTestKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newJWTTestKeys(t *testing.T) *jwtTestKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &jwtTestKeys{rsa: rsaKey, ec: ecKey}
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (k *jwtTestKeys) jwks() []byte {
+	ecX, ecY := make([]byte, 32), make([]byte, 32)
+	k.ec.X.FillBytes(ecX)
+	k.ec.Y.FillBytes(ecY)
+	data, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(k.rsa.N.Bytes()), "e": b64(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecX), "y": b64(ecY)},
+	}})
+	return data
+}
+
+// sign builds a token with the given header; the signature follows alg, with
+// HS256 keyed by hmacKey
+func (k *jwtTestKeys) sign(t *testing.T, alg, kid string, hmacKey []byte, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, hmacKey)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + b64(sig)
+}
+
+func newTestJWTProvider(t *testing.T, keys *jwtTestKeys, cfg JWTConfig) *JWTProvider {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, keys.jwks(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.JWKSFile = path
+	p, err := NewJWTProvider(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestJWTVerify(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	now := time.Now().Unix()
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{"sub": "user-1", "iss": "https://issuer.example", "aud": "viddown", "exp": now + 60}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	rsaPublicDER, _ := x509.MarshalPKIXPublicKey(&keys.rsa.PublicKey)
+
+	jwksOnly := newTestJWTProvider(t, keys, JWTConfig{
+		Issuer:    "https://issuer.example",
+		Audience:  "viddown",
+		ClockSkew: 30 * time.Second,
+	})
+	withHMAC := newTestJWTProvider(t, keys, JWTConfig{
+		HMACSecret: testHMACSecret,
+		Issuer:     "https://issuer.example",
+		Audience:   "viddown",
+		ClockSkew:  30 * time.Second,
+	})
+
+	tests := []struct {
+		name     string
+		provider *JWTProvider
+		token    string
+		want     error
+	}{
+		{"RS256", jwksOnly, keys.sign(t, "RS256", "rsa", nil, claims(nil)), nil},
+		{"ES256", jwksOnly, keys.sign(t, "ES256", "ec", nil, claims(nil)), nil},
+		{"HS256", withHMAC, keys.sign(t, "HS256", "", []byte(testHMACSecret), claims(nil)), nil},
+		{"aud array", jwksOnly, keys.sign(t, "RS256", "rsa", nil, claims(map[string]any{"aud": []string{"other", "viddown"}})), nil},
+		{"exp within skew", jwksOnly, keys.sign(t, "RS256", "rsa", nil, claims(map[string]any{"exp": now - 10})), nil},
+		{"nbf within skew", jwksOnly, keys.sign(t, "RS256", "rsa", nil, claims(map[string]any{"nbf": now + 10})), nil},
+
+		{"alg none", jwksOnly, keys.sign(t, "none", "rsa", nil, claims(nil)), ErrInvalidJWT},
+		{"alg none without kid", withHMAC, keys.sign(t, "none", "", nil, claims(nil)), ErrInvalidJWT},
+		{"HS256 keyed with the RSA public key", jwksOnly, keys.sign(t, "HS256", "rsa", rsaPublicDER, claims(nil)), ErrInvalidJWT},
+		{"HS256 keyed with the RSA public key, HMAC configured", withHMAC, keys.sign(t, "HS256", "rsa", rsaPublicDER, claims(nil)), ErrInvalidJWT},
+		{"RS256 header on an HMAC signature", withHMAC, swapAlg(t, keys.sign(t, "HS256", "rsa", []byte(testHMACSecret), claims(nil)), "RS256"), ErrInvalidJWT},
+		{"ES256 token naming the RSA key", jwksOnly, keys.sign(t, "ES256", "rsa", nil, claims(nil)), ErrInvalidJWT},
+		{"unknown kid", jwksOnly, keys.sign(t, "RS256", "other", nil, claims(nil)), ErrInvalidJWT},
+		{"tampered claims", jwksOnly, tamperClaims(t, keys.sign(t, "RS256", "rsa", nil, claims(nil)), claims(map[string]any{"sub": "admin"})), ErrInvalidJWT},
+		{"expired beyond skew", jwksOnly, keys.sign(t, "RS256", "rsa", nil, claims(map[string]any{"exp": now - 60})), ErrExpiredJWT},
+		{"nbf beyond skew", jwksOnly, keys.sign(t, "RS256", "rsa", nil, claims(map[string]any{"nbf": now + 60})), ErrInvalidJWT},
+		{"missing exp", jwksOnly, keys.sign(t, "RS256", "rsa", nil, claims(map[string]any{"exp": nil})), ErrInvalidJWT},
+		{"missing sub", jwksOnly, keys.sign(t, "RS256", "rsa", nil, claims(map[string]any{"sub": nil})), ErrInvalidJWT},
+		{"wrong issuer", jwksOnly, keys.sign(t, "RS256", "rsa", nil, claims(map[string]any{"iss": "https://evil.example"})), ErrInvalidJWT},
+		{"wrong aud string", jwksOnly, keys.sign(t, "RS256", "rsa", nil, claims(map[string]any{"aud": "other"})), ErrInvalidJWT},
+		{"wrong aud array", jwksOnly, keys.sign(t, "RS256", "rsa", nil, claims(map[string]any{"aud": []string{"other", "viddown-admin"}})), ErrInvalidJWT},
+		{"aud of the wrong type", jwksOnly, keys.sign(t, "RS256", "rsa", nil, claims(map[string]any{"aud": 42})), ErrInvalidJWT},
+		{"two parts", jwksOnly, "a.b", ErrInvalidJWT},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := tt.provider.verify(tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("verify error = %v, want %v", err, tt.want)
+			}
+			if err == nil && claims.Subject != "user-1" {
+				t.Fatalf("verify subject = %q, want user-1", claims.Subject)
+			}
+		})
+	}
+}
+
+// swapAlg replaces the token's header alg, keeping the payload and signature
+func swapAlg(t *testing.T, token, alg string) string {
+	t.Helper()
+	var header map[string]string
+	parts := splitToken(t, token)
+	if err := decodeSegment(parts[0], &header); err != nil {
+		t.Fatal(err)
+	}
+	header["alg"] = alg
+	data, _ := json.Marshal(header)
+	return b64(data) + "." + parts[1] + "." + parts[2]
+}
+
+// tamperClaims replaces the token's payload, keeping its signature
+func tamperClaims(t *testing.T, token string, claims map[string]any) string {
+	t.Helper()
+	parts := splitToken(t, token)
+	data, _ := json.Marshal(claims)
+	return parts[0] + "." + b64(data) + "." + parts[2]
+}
+
+func splitToken(t *testing.T, token string) []string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token %q has %d parts", token, len(parts))
+	}
+	return parts
+}
+
+func TestParseJWKS(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		jwks    string
+		kids    []string
+		wantErr bool
+	}{
+		{"RSA and EC", string(keys.jwks()), []string{"rsa", "ec"}, false},
+		{"encryption keys skipped", `{"keys": [{"kty": "RSA", "kid": "enc", "use": "enc", "n": "` + b64(keys.rsa.N.Bytes()) + `", "e": "AQAB"}, {"kty": "RSA", "kid": "sig", "n": "` + b64(keys.rsa.N.Bytes()) + `", "e": "AQAB"}]}`, []string{"sig"}, false},
+		{"unsupported types skipped", `{"keys": [{"kty": "oct", "kid": "sym", "k": "c2VjcmV0"}, {"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": "AA"}, {"kty": "RSA", "kid": "rsa", "n": "` + b64(keys.rsa.N.Bytes()) + `", "e": "AQAB"}]}`, []string{"rsa"}, false},
+		{"weak RSA key", `{"keys": [{"kty": "RSA", "kid": "weak", "n": "` + b64(weak.N.Bytes()) + `", "e": "AQAB"}]}`, nil, true},
+		{"RSA exponent 1", `{"keys": [{"kty": "RSA", "kid": "e1", "n": "` + b64(keys.rsa.N.Bytes()) + `", "e": "AQ"}]}`, nil, true},
+		{"EC point off the curve", `{"keys": [{"kty": "EC", "kid": "bad", "crv": "P-256", "x": "` + b64(make([]byte, 32)) + `", "y": "` + b64(make([]byte, 32)) + `"}]}`, nil, true},
+		{"only symmetric keys", `{"keys": [{"kty": "oct", "kid": "sym", "k": "c2VjcmV0"}]}`, nil, true},
+		{"empty", `{"keys": []}`, nil, true},
+		{"not JSON", `<html>`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseJWKS([]byte(tt.jwks))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseJWKS error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.kids) {
+				t.Fatalf("parseJWKS returned %d keys, want %v", len(got), tt.kids)
+			}
+			for _, kid := range tt.kids {
+				if got[kid] == nil {
+					t.Fatalf("parseJWKS is missing %q", kid)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,544 @@
+package middleware
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cookies of the OIDC flow
+const (
+	sessionCookie = "viddown_session"
+	flowCookie    = "viddown_oidc"
+	flowTTL       = 10 * time.Minute
+)
+
+// refreshReuse is how long the result of a token refresh is reused, so
+// parallel requests with an expired session refresh once; providers that
+// rotate refresh tokens reject the second use
+const refreshReuse = 30 * time.Second
+
+var errNoSession = errors.New("no session")
+
+// OIDCConfig configures OIDCProvider
+type OIDCConfig struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string // Empty for public clients, which rely on PKCE alone
+	RedirectURL   string // Absolute URL of the callback route
+	Scopes        []string
+	PostLogoutURL string        // Where the browser goes after logout
+	SessionKey    []byte        // AES-256 key encrypting cookies; random if empty
+	SessionTTL    time.Duration // Absolute session lifetime, refreshes included
+	CookieSecure  bool
+	ClockSkew     time.Duration
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// OIDCProvider signs users in with the OpenID Connect authorization code
+// flow with PKCE. The session lives in an encrypted cookie, so nothing is
+// stored server-side; it is refreshed with the refresh token when the ID
+// token expires. Bearer tokens issued by the same provider are accepted too.
+type OIDCProvider struct {
+	cfg      OIDCConfig
+	logger   *slog.Logger
+	meta     oidcMetadata
+	verifier *JWTProvider
+	aead     cipher.AEAD
+
+	mu         sync.Mutex
+	refreshing map[string]*refreshCall
+}
+
+type refreshCall struct {
+	done    chan struct{}
+	session *session
+	err     error
+	at      time.Time
+}
+
+// session is the content of the session cookie
+type session struct {
+	User         User   `json:"user"`
+	Expires      int64  `json:"exp"` // ID token expiry, Unix seconds
+	RefreshToken string `json:"rt,omitempty"`
+	IDToken      string `json:"idt,omitempty"` // Sent as id_token_hint on logout
+	Created      int64  `json:"iat"`
+}
+
+// flowState is kept in a short-lived cookie between login and callback
+type flowState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"return_to"`
+	Expires  int64  `json:"exp"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+// NewOIDCProvider discovers the issuer's endpoints and keys
+func NewOIDCProvider(cfg OIDCConfig, logger *slog.Logger) (*OIDCProvider, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("OIDC needs an issuer, client ID and redirect URL")
+	}
+
+	data, err := fetchURL(strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	var meta oidcMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	if meta.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %q, expected %q", meta.Issuer, cfg.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery is missing endpoints")
+	}
+
+	verifier, err := NewJWTProvider(JWTConfig{
+		JWKSURL:    meta.JWKSURI,
+		JWKSReload: time.Hour,
+		Issuer:     meta.Issuer,
+		Audience:   cfg.ClientID,
+		ClockSkew:  cfg.ClockSkew,
+	}, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	key := cfg.SessionKey
+	if len(key) == 0 {
+		logger.Warn("SESSION_KEY not set, sessions won't survive a restart")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCProvider{
+		cfg:        cfg,
+		logger:     logger,
+		meta:       meta,
+		verifier:   verifier,
+		aead:       aead,
+		refreshing: make(map[string]*refreshCall),
+	}, nil
+}
+
+// Validate accepts bearer tokens (ID tokens or JWT access tokens) issued to
+// this client
+func (p *OIDCProvider) Validate(token string) (*User, error) {
+	return p.verifier.Validate(token)
+}
+
+// SessionUser returns the user of the session cookie, refreshing the session
+// when its ID token expired
+func (p *OIDCProvider) SessionUser(w http.ResponseWriter, r *http.Request) (*User, error) {
+	s, ok := p.readSession(r)
+	if !ok {
+		return nil, errNoSession
+	}
+
+	now := time.Now()
+	if now.After(time.Unix(s.Created, 0).Add(p.cfg.SessionTTL)) {
+		return nil, errNoSession
+	}
+	if now.Unix() < s.Expires {
+		return &s.User, nil
+	}
+	if s.RefreshToken == "" {
+		return nil, errNoSession
+	}
+
+	refreshed, err := p.refresh(r.Context(), s)
+	if err != nil {
+		p.logger.Info("Session refresh failed", "user", s.User.ID, "error", err)
+		p.clearCookie(w, sessionCookie, "/")
+		return nil, errNoSession
+	}
+	p.setSession(w, refreshed)
+	return &refreshed.User, nil
+}
+
+// refresh exchanges the session's refresh token, sharing the result with
+// concurrent requests of the same session
+func (p *OIDCProvider) refresh(ctx context.Context, s *session) (*session, error) {
+	p.mu.Lock()
+	for token, call := range p.refreshing {
+		select {
+		case <-call.done:
+			if time.Since(call.at) > refreshReuse {
+				delete(p.refreshing, token)
+			}
+		default:
+		}
+	}
+	call, ok := p.refreshing[s.RefreshToken]
+	if !ok {
+		call = &refreshCall{done: make(chan struct{})}
+		p.refreshing[s.RefreshToken] = call
+	}
+	p.mu.Unlock()
+
+	if ok {
+		select {
+		case <-call.done:
+			return call.session, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	call.session, call.err = p.doRefresh(s)
+	call.at = time.Now()
+	close(call.done)
+	return call.session, call.err
+}
+
+func (p *OIDCProvider) doRefresh(s *session) (*session, error) {
+	tokens, err := p.tokenRequest(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.RefreshToken},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refreshed := *s
+	if tokens.RefreshToken != "" {
+		refreshed.RefreshToken = tokens.RefreshToken
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("refresh returned no ID token")
+	}
+	claims, err := p.verifier.verify(tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject != s.User.ID {
+		return nil, fmt.Errorf("refreshed ID token is for another subject")
+	}
+	refreshed.User = *claims.user()
+	refreshed.Expires = int64(*claims.Expires)
+	refreshed.IDToken = tokens.IDToken
+	return &refreshed, nil
+}
+
+// readSession decrypts the session cookie, whether or not it expired
+func (p *OIDCProvider) readSession(r *http.Request) (*session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	var s session
+	if err := p.open(sessionCookie, cookie.Value, &s); err != nil {
+		return nil, false
+	}
+	return &s, true
+}
+
+// Login starts the flow: it redirects to the provider with a fresh state,
+// nonce and PKCE challenge, kept in the flow cookie
+func (p *OIDCProvider) Login(w http.ResponseWriter, r *http.Request) {
+	flow := flowState{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		ReturnTo: safeReturnTo(r.URL.Query().Get("return_to")),
+		Expires:  time.Now().Add(flowTTL).Unix(),
+	}
+	value, err := p.seal(flowCookie, flow)
+	if err != nil {
+		http.Error(w, `{"error": "Internal error"}`, http.StatusInternalServerError)
+		return
+	}
+	p.setCookie(w, flowCookie, value, "/api/auth", flowTTL)
+
+	challenge := sha256.Sum256([]byte(flow.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {flow.State},
+		"nonce":                 {flow.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, appendQuery(p.meta.AuthorizationEndpoint, query), http.StatusFound)
+}
+
+// Callback completes the flow: it checks the state, exchanges the code with
+// the PKCE verifier, verifies the ID token and its nonce, and starts the
+// session
+func (p *OIDCProvider) Callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		p.logger.Warn("OIDC login failed at the provider", "error", errCode, "description", query.Get("error_description"))
+		http.Error(w, `{"error": "Login failed"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var flow flowState
+	cookie, err := r.Cookie(flowCookie)
+	if err != nil || p.open(flowCookie, cookie.Value, &flow) != nil || time.Now().Unix() > flow.Expires {
+		http.Error(w, `{"error": "Login expired, please try again"}`, http.StatusBadRequest)
+		return
+	}
+	p.clearCookie(w, flowCookie, "/api/auth")
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(flow.State)) != 1 {
+		http.Error(w, `{"error": "Invalid login state"}`, http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := p.tokenRequest(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {flow.Verifier},
+	})
+	if err != nil {
+		p.logger.Warn("OIDC code exchange failed", "error", err)
+		http.Error(w, `{"error": "Login failed"}`, http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := p.verifier.verify(tokens.IDToken)
+	if err == nil && subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(flow.Nonce)) != 1 {
+		err = fmt.Errorf("%w: nonce mismatch", ErrInvalidJWT)
+	}
+	if err != nil {
+		p.logger.Warn("OIDC ID token rejected", "error", err)
+		http.Error(w, `{"error": "Login failed"}`, http.StatusUnauthorized)
+		return
+	}
+
+	user := claims.user()
+	p.setSession(w, &session{
+		User:         *user,
+		Expires:      int64(*claims.Expires),
+		RefreshToken: tokens.RefreshToken,
+		IDToken:      tokens.IDToken,
+		Created:      time.Now().Unix(),
+	})
+	p.logger.Info("User signed in", "user", user.ID, "email", user.Email)
+	http.Redirect(w, r, flow.ReturnTo, http.StatusFound)
+}
+
+// Logout ends the session, and the provider's session when it supports
+// RP-initiated logout. It only takes POSTs from the UI's own origin, so other
+// sites can't sign users out.
+func (p *OIDCProvider) Logout(w http.ResponseWriter, r *http.Request) {
+	if !p.sameOrigin(r) {
+		http.Error(w, `{"error": "Cross-site logout rejected"}`, http.StatusForbidden)
+		return
+	}
+	s, _ := p.readSession(r)
+	p.clearCookie(w, sessionCookie, "/")
+
+	target := p.cfg.PostLogoutURL
+	if p.meta.EndSessionEndpoint != "" {
+		query := url.Values{"client_id": {p.cfg.ClientID}}
+		if s != nil && s.IDToken != "" {
+			// Most providers only honor post_logout_redirect_uri with a hint
+			query.Set("id_token_hint", s.IDToken)
+		}
+		if strings.HasPrefix(p.cfg.PostLogoutURL, "http") {
+			query.Set("post_logout_redirect_uri", p.cfg.PostLogoutURL)
+		}
+		target = appendQuery(p.meta.EndSessionEndpoint, query)
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// sameOrigin reports whether a request comes from a page of this server:
+// its host, or the public host of the redirect URL when a proxy rewrites
+// Host. Browsers send Origin with every POST; Sec-Fetch-Site covers the rest.
+func (p *OIDCProvider) sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	public, _ := url.Parse(p.cfg.RedirectURL)
+	return u.Host == r.Host || (public != nil && u.Scheme == public.Scheme && u.Host == public.Host)
+}
+
+// Me returns the signed-in user
+func (p *OIDCProvider) Me(w http.ResponseWriter, r *http.Request) {
+	user, err := p.SessionUser(w, r)
+	if err != nil {
+		http.Error(w, `{"error": "Not signed in", "code": "unauthenticated"}`, http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// tokenRequest posts to the token endpoint, authenticating the client with
+// its secret when it has one
+func (p *OIDCProvider) tokenRequest(form url.Values) (*tokenResponse, error) {
+	form.Set("client_id", p.cfg.ClientID)
+	req, err := http.NewRequest(http.MethodPost, p.meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tokens tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponse)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("invalid token response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("token endpoint: %s %s", tokens.Error, tokens.Description)
+	}
+	return &tokens, nil
+}
+
+func (p *OIDCProvider) setSession(w http.ResponseWriter, s *session) {
+	value, err := p.seal(sessionCookie, s)
+	if err != nil {
+		p.logger.Error("Failed to seal session", "error", err)
+		return
+	}
+	remaining := time.Until(time.Unix(s.Created, 0).Add(p.cfg.SessionTTL))
+	p.setCookie(w, sessionCookie, value, "/", remaining)
+}
+
+func (p *OIDCProvider) setCookie(w http.ResponseWriter, name, value, path string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   p.cfg.CookieSecure,
+		// Lax, so the cookie comes along when the provider redirects back
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (p *OIDCProvider) clearCookie(w http.ResponseWriter, name, path string) {
+	p.setCookie(w, name, "", path, -time.Second)
+}
+
+// seal encrypts v for the cookie name; the name is authenticated, so one
+// cookie can't be replayed as another
+func (p *OIDCProvider) seal(name string, v any) (string, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := p.aead.Seal(nonce, nonce, plain, []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (p *OIDCProvider) open(name, value string, v any) error {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < p.aead.NonceSize() {
+		return errNoSession
+	}
+	nonce, ciphertext := sealed[:p.aead.NonceSize()], sealed[p.aead.NonceSize():]
+	plain, err := p.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return errNoSession
+	}
+	return json.Unmarshal(plain, v)
+}
+
+// safeReturnTo allows only local paths, so login can't redirect elsewhere
+func safeReturnTo(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.Contains(path, "\\") {
+		return "/"
+	}
+	return path
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func appendQuery(endpoint string, query url.Values) string {
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+	return endpoint + sep + query.Encode()
+}
+
+const maxOIDCResponse = 1 << 20
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// fetchURL GETs a discovery document or JWKS
+func fetchURL(rawURL string) ([]byte, error) {
+	resp, err := oidcClient.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: status %d", rawURL, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxOIDCResponse))
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"127.0.0.1/8", "::1/128", "10.0.0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		forwarded  string
+		want       string
+	}{
+		{"direct IPv4", "203.0.113.7:51234", "", "", "203.0.113.7"},
+		{"direct IPv6 keeps no port", "[2001:db8::1]:54321", "", "", "2001:db8::1"},
+		{"direct client can't spoof XFF", "203.0.113.7:51234", "", "198.51.100.1", "203.0.113.7"},
+		{"direct client can't spoof X-Real-IP", "203.0.113.7:51234", "198.51.100.1", "", "203.0.113.7"},
+		{"trusted proxy X-Real-IP", "127.0.0.1:40000", "198.51.100.1", "", "198.51.100.1"},
+		{"trusted proxy IPv6 peer", "[::1]:40000", "198.51.100.1", "", "198.51.100.1"},
+		{"XFF takes the last untrusted hop", "127.0.0.1:40000", "", "6.6.6.6, 198.51.100.1, 10.0.0.5", "198.51.100.1"},
+		{"garbage XFF is ignored", "127.0.0.1:40000", "", "not-an-ip", "127.0.0.1"},
+		{"proxy without headers", "127.0.0.1:40000", "", "", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := RealIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = ClientIP(r)
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesRejectsGarbage(t *testing.T) {
+	if _, err := ParseTrustedProxies([]string{"10.0.0.0/8", "proxy.local"}); err == nil {
+		t.Fatal("expected an error for a hostname")
+	}
+}
@@ -0,0 +1,62 @@
+package services
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// zipFiles packs files into a zip at zipPath, sorted by name, with
+// trimPrefix removed from the entry names. Media is already compressed, so
+// files are stored as is.
+func zipFiles(files []string, zipPath, trimPrefix string) error {
+	sort.Strings(files)
+
+	out, err := os.Create(zipPath)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(out)
+	for _, path := range files {
+		if err := addToZip(zw, path, trimPrefix); err != nil {
+			out.Close()
+			os.Remove(zipPath)
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(zipPath)
+		return err
+	}
+	return out.Close()
+}
+
+func addToZip(zw *zip.Writer, path, trimPrefix string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(stat)
+	if err != nil {
+		return err
+	}
+	header.Name = strings.TrimPrefix(header.Name, trimPrefix)
+	header.Method = zip.Store
+
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, in)
+	return err
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+type analyzeCacheEntry struct {
+	info    *VideoInfo
+	expires time.Time
+}
+
+// AnalyzeCache keeps recent Analyze results in memory, keyed by platform and
+// video ID
+type AnalyzeCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*analyzeCacheEntry
+}
+
+// NewAnalyzeCache creates a cache holding up to maxEntries results for ttl.
+// A zero ttl disables caching.
+func NewAnalyzeCache(ttl time.Duration, maxEntries int) *AnalyzeCache {
+	return &AnalyzeCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*analyzeCacheEntry),
+	}
+}
+
+// Get returns the cached result for key, if present and not expired
+func (c *AnalyzeCache) Get(key string) (*VideoInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.info, true
+}
+
+// Set stores a result, evicting expired and then the oldest entries when the
+// cache is full
+func (c *AnalyzeCache) Set(key string, info *VideoInfo) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		c.evictLocked()
+	}
+	c.entries[key] = &analyzeCacheEntry{
+		info:    info,
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+// Delete removes the result for key
+func (c *AnalyzeCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+func (c *AnalyzeCache) evictLocked() {
+	now := time.Now()
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldestKey == "" || entry.expires.Before(oldest) {
+			oldestKey, oldest = key, entry.expires
+		}
+	}
+	if len(c.entries) >= c.maxEntries && oldestKey != "" {
+		delete(c.entries, oldestKey)
+	}
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Chapter is a chapter of a video, numbered from 1
+type Chapter struct {
+	Number int     `json:"number"`
+	Title  string  `json:"title"`
+	Start  float64 `json:"start"`
+	End    float64 `json:"end"`
+}
+
+type ytdlpChapter struct {
+	StartTime float64 `json:"start_time"`
+	EndTime   float64 `json:"end_time"`
+	Title     string  `json:"title"`
+}
+
+func parseChapters(ytChapters []ytdlpChapter) []Chapter {
+	var chapters []Chapter
+	for i, c := range ytChapters {
+		title := c.Title
+		if title == "" {
+			title = fmt.Sprintf("Chapter %d", i+1)
+		}
+		chapters = append(chapters, Chapter{
+			Number: i + 1,
+			Title:  title,
+			Start:  c.StartTime,
+			End:    c.EndTime,
+		})
+	}
+	return chapters
+}
+
+// chapterOutputTemplate names split chapter files with track numbers
+const chapterOutputTemplate = "%(section_number)02d - %(section_title).150B.%(ext)s"
+
+// resolveChapter turns opts.Chapter into clip boundaries using the analyzed
+// chapter list
+func (s *YtDlpService) resolveChapter(ctx context.Context, url string, opts DownloadOptions) (DownloadOptions, error) {
+	if opts.Chapter == 0 {
+		return opts, nil
+	}
+
+	info, err := s.Analyze(ctx, url)
+	if err != nil {
+		return opts, err
+	}
+	if opts.Chapter > len(info.Chapters) {
+		return opts, fmt.Errorf("%w: video has %d chapters", ErrInvalidOptions, len(info.Chapters))
+	}
+
+	chapter := info.Chapters[opts.Chapter-1]
+	opts.Start = chapter.Start
+	opts.End = chapter.End
+	opts.chapterTitle = chapter.Title
+	return opts, nil
+}
+
+// chapterSuffix is appended to the filename of a single chapter download
+func (o DownloadOptions) chapterSuffix() string {
+	return fmt.Sprintf(" - %02d - %s", o.Chapter, escapeTemplate(o.chapterTitle))
+}
+
+// escapeTemplate makes text safe to embed in a yt-dlp output template
+func escapeTemplate(s string) string {
+	return strings.NewReplacer("%", "%%", "/", "_", "\\", "_").Replace(s)
+}
+
+// zipChapters packs the split chapter files in dir into a zip at zipPath
+func zipChapters(dir, zipPath string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("video has no chapters to split")
+	}
+	return zipFiles(files, zipPath, "")
+}
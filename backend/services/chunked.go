@@ -0,0 +1,265 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrChunkingUnsupported means the stream can't be fetched in parallel (no
+// known size, range requests not honored, or too small to be worth it)
+var ErrChunkingUnsupported = errors.New("chunked fetching not supported for this stream")
+
+// ChunkedFetcher downloads a CDN URL over several connections in parallel,
+// one byte range per request, and reassembles the chunks in order. YouTube
+// throttles single connections, so this gets much closer to the available
+// bandwidth. Memory is bounded to connections * chunkSize.
+type ChunkedFetcher struct {
+	client      *http.Client
+	connections int
+	chunkSize   int64
+	maxRetries  int
+}
+
+func NewChunkedFetcher(client *http.Client, connections int, chunkSize int64, maxRetries int) *ChunkedFetcher {
+	return &ChunkedFetcher{
+		client:      client,
+		connections: connections,
+		chunkSize:   chunkSize,
+		maxRetries:  maxRetries,
+	}
+}
+
+// Enabled reports whether parallel fetching is configured
+func (f *ChunkedFetcher) Enabled() bool {
+	return f.connections > 1 && f.chunkSize > 0
+}
+
+// ChunkedStream is an opened parallel download of a byte range
+type ChunkedStream struct {
+	Start int64
+	End   int64
+	Total int64
+
+	f       *ChunkedFetcher
+	refresh RefreshFunc
+
+	mu   sync.Mutex
+	info *StreamInfo
+}
+
+// Open probes the stream size and prepares fetching the range requested by
+// rangeHeader, which may be empty or a single "bytes=N-" / "bytes=N-M"
+// range. It returns ErrChunkingUnsupported when the caller should fall back
+// to a single connection.
+func (f *ChunkedFetcher) Open(ctx context.Context, info *StreamInfo, rangeHeader string, refresh RefreshFunc) (*ChunkedStream, error) {
+	start, end := int64(0), int64(-1)
+	if rangeHeader != "" {
+		m := singleRangePattern.FindStringSubmatch(rangeHeader)
+		if m == nil {
+			return nil, ErrChunkingUnsupported
+		}
+		start, _ = strconv.ParseInt(m[1], 10, 64)
+		if m[2] != "" {
+			end, _ = strconv.ParseInt(m[2], 10, 64)
+		}
+	}
+
+	s := &ChunkedStream{f: f, refresh: refresh, info: info}
+
+	total, err := s.probeSize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if end < 0 || end >= total {
+		end = total - 1
+	}
+	if start > end {
+		return nil, &RangeError{Total: total}
+	}
+	if end-start+1 <= f.chunkSize {
+		return nil, ErrChunkingUnsupported
+	}
+
+	s.Start, s.End, s.Total = start, end, total
+	return s, nil
+}
+
+// Length returns the number of bytes the stream will write
+func (s *ChunkedStream) Length() int64 {
+	return s.End - s.Start + 1
+}
+
+// WriteTo fetches the chunks in parallel and writes them to w in order
+func (s *ChunkedStream) WriteTo(ctx context.Context, w io.Writer) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	numChunks := int((s.Length() + s.f.chunkSize - 1) / s.f.chunkSize)
+	results := make([]chan chunkResult, numChunks)
+	for i := range results {
+		results[i] = make(chan chunkResult, 1)
+	}
+
+	// window limits chunks fetched or waiting to be written; a slot is freed
+	// only after its chunk was written
+	window := make(chan struct{}, s.f.connections)
+	go func() {
+		for i := 0; i < numChunks; i++ {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			from := s.Start + int64(i)*s.f.chunkSize
+			to := min(from+s.f.chunkSize-1, s.End)
+			go func(i int) {
+				data, err := s.fetchChunk(ctx, from, to)
+				results[i] <- chunkResult{data: data, err: err}
+			}(i)
+		}
+	}()
+
+	var written int64
+	for i := 0; i < numChunks; i++ {
+		var res chunkResult
+		select {
+		case res = <-results[i]:
+		case <-ctx.Done():
+			return written, ctx.Err()
+		}
+		if res.err != nil {
+			return written, res.err
+		}
+
+		n, err := w.Write(res.data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		<-window
+	}
+
+	return written, nil
+}
+
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+func (s *ChunkedStream) fetchChunk(ctx context.Context, from, to int64) ([]byte, error) {
+	var lastErr error
+	for attempt := 0; attempt <= s.f.maxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(attempt) * reconnectBackoff):
+			}
+		}
+
+		info := s.currentInfo()
+		resp, err := s.get(ctx, info, fmt.Sprintf("bytes=%d-%d", from, to))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if isExpired(resp) && s.refresh != nil {
+			resp.Body.Close()
+			if err := s.refreshURL(ctx, info); err != nil {
+				return nil, err
+			}
+			lastErr = fmt.Errorf("stream URL expired")
+			continue
+		}
+		if resp.StatusCode != http.StatusPartialContent || !rangeStartsAt(resp, from) {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("unexpected status %d for chunk %d-%d", resp.StatusCode, from, to)
+			continue
+		}
+
+		data := make([]byte, to-from+1)
+		_, err = io.ReadFull(resp.Body, data)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("chunk %d-%d failed after %d retries: %w", from, to, s.f.maxRetries, lastErr)
+}
+
+// probeSize requests the first byte to learn the total size and whether the
+// CDN honors range requests
+func (s *ChunkedStream) probeSize(ctx context.Context) (int64, error) {
+	info := s.currentInfo()
+	resp, err := s.get(ctx, info, "bytes=0-0")
+	if err != nil {
+		return 0, err
+	}
+	if isExpired(resp) && s.refresh != nil {
+		resp.Body.Close()
+		if err := s.refreshURL(ctx, info); err != nil {
+			return 0, err
+		}
+		if resp, err = s.get(ctx, s.currentInfo(), "bytes=0-0"); err != nil {
+			return 0, err
+		}
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, ErrChunkingUnsupported
+	}
+	var start, end, total int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil || total <= 0 {
+		return 0, ErrChunkingUnsupported
+	}
+	return total, nil
+}
+
+func (s *ChunkedStream) get(ctx context.Context, info *StreamInfo, rangeHeader string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", info.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
+	for key, value := range info.Headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Range", rangeHeader)
+
+	return s.f.client.Do(req)
+}
+
+func (s *ChunkedStream) currentInfo() *StreamInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info
+}
+
+// refreshURL replaces the expired URL. stale is the info the failed request
+// used; when another chunk already refreshed it, the new URL is kept.
+func (s *ChunkedStream) refreshURL(ctx context.Context, stale *StreamInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.info != stale {
+		return nil
+	}
+	info, err := s.refresh(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to refresh stream URL: %w", err)
+	}
+	s.info = info
+	return nil
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testChunkSize = 10_000
+
+func fetchChunked(t *testing.T, server *cdnServer, info *StreamInfo, rangeHeader string, refresh RefreshFunc, maxRetries int) ([]byte, *ChunkedStream, error) {
+	t.Helper()
+	f := NewChunkedFetcher(server.Client(), 4, testChunkSize, maxRetries)
+	stream, err := f.Open(context.Background(), info, rangeHeader, refresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	var out bytes.Buffer
+	written, err := stream.WriteTo(context.Background(), &out)
+	if written != int64(out.Len()) {
+		t.Fatalf("WriteTo reported %d bytes, wrote %d", written, out.Len())
+	}
+	return out.Bytes(), stream, err
+}
+
+func TestChunkedStreamAssemblesInOrder(t *testing.T) {
+	// Not a multiple of the chunk size, so the last chunk is short
+	data := randomBytes(t, 100_003)
+	var server *cdnServer
+	server = newCDNServer(t, data, func(i int, w http.ResponseWriter, r *http.Request) bool {
+		// Finish chunks out of order
+		time.Sleep(time.Duration(rand.IntN(5)) * time.Millisecond)
+		return false
+	})
+
+	tests := []struct {
+		name        string
+		rangeHeader string
+		start, end  int64
+	}{
+		{"whole stream", "", 0, 100_002},
+		{"open range", "bytes=5000-", 5000, 100_002},
+		{"closed range", "bytes=5000-54320", 5000, 54320},
+		{"range past the end", "bytes=5000-200000", 5000, 100_002},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, stream, err := fetchChunked(t, server, &StreamInfo{URL: server.URL}, tt.rangeHeader, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stream.Start != tt.start || stream.End != tt.end || stream.Total != int64(len(data)) {
+				t.Fatalf("stream = %d-%d/%d, want %d-%d/%d", stream.Start, stream.End, stream.Total, tt.start, tt.end, len(data))
+			}
+			if !bytes.Equal(got, data[tt.start:tt.end+1]) {
+				t.Fatalf("got %d bytes, want %d matching bytes", len(got), tt.end-tt.start+1)
+			}
+		})
+	}
+}
+
+func TestChunkedStreamRetriesChunks(t *testing.T) {
+	fastReconnects(t)
+	data := randomBytes(t, 100_003)
+
+	tests := []struct {
+		name       string
+		breakChunk func(s *cdnServer, w http.ResponseWriter, r *http.Request)
+	}{
+		{"dropped connection", func(s *cdnServer, w http.ResponseWriter, r *http.Request) { s.serveRange(w, r, 100) }},
+		{"server error", func(s *cdnServer, w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}},
+		{"range ignored", func(s *cdnServer, w http.ResponseWriter, r *http.Request) {
+			r.Header.Del("Range")
+			s.serveRange(w, r, -1)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var server *cdnServer
+			var broken atomic.Int32
+			server = newCDNServer(t, data, func(i int, w http.ResponseWriter, r *http.Request) bool {
+				// Break the first attempt of two chunks, the last one included
+				rangeHeader := r.Header.Get("Range")
+				if (rangeHeader == "bytes=20000-29999" || rangeHeader == "bytes=100000-100002") && broken.Add(1) <= 2 {
+					tt.breakChunk(server, w, r)
+					return true
+				}
+				return false
+			})
+
+			got, _, err := fetchChunked(t, server, &StreamInfo{URL: server.URL}, "", nil, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("assembled stream doesn't match")
+			}
+		})
+	}
+}
+
+func TestChunkedStreamFailsAfterRetries(t *testing.T) {
+	fastReconnects(t)
+	data := randomBytes(t, 100_003)
+	var server *cdnServer
+	server = newCDNServer(t, data, func(i int, w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Range") == "bytes=50000-59999" {
+			server.serveRange(w, r, 100)
+			return true
+		}
+		return false
+	})
+
+	got, _, err := fetchChunked(t, server, &StreamInfo{URL: server.URL}, "", nil, 2)
+	if err == nil {
+		t.Fatal("expected an error for a chunk that never arrives")
+	}
+	// Nothing after the failed chunk is written
+	if !bytes.Equal(got, data[:len(got)]) || len(got) > 50_000 {
+		t.Fatalf("wrote %d bytes, want a prefix up to the failed chunk", len(got))
+	}
+}
+
+func TestChunkedStreamRefreshesExpiredURL(t *testing.T) {
+	fastReconnects(t)
+	data := randomBytes(t, 100_003)
+	var server *cdnServer
+	server = newCDNServer(t, data, func(i int, w http.ResponseWriter, r *http.Request) bool {
+		// The URL expires right after the size probe
+		if r.URL.Path == "/old" && r.Header.Get("Range") != "bytes=0-0" {
+			w.WriteHeader(http.StatusForbidden)
+			return true
+		}
+		return false
+	})
+	var refreshes atomic.Int32
+	refresh := func(ctx context.Context) (*StreamInfo, error) {
+		refreshes.Add(1)
+		return &StreamInfo{URL: server.URL + "/new"}, nil
+	}
+
+	got, _, err := fetchChunked(t, server, &StreamInfo{URL: server.URL + "/old"}, "", refresh, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("assembled stream doesn't match")
+	}
+	// Chunks failing in parallel share one refresh
+	if n := refreshes.Load(); n != 1 {
+		t.Fatalf("refreshed %d times, want 1", n)
+	}
+}
+
+func TestChunkedFetcherOpen(t *testing.T) {
+	data := randomBytes(t, 100_003)
+	server := newCDNServer(t, data, nil)
+	noRanges := newCDNServer(t, data, func(i int, w http.ResponseWriter, r *http.Request) bool {
+		r.Header.Del("Range")
+		return false
+	})
+	small := newCDNServer(t, data[:testChunkSize], nil)
+
+	tests := []struct {
+		name        string
+		url         string
+		rangeHeader string
+		want        error
+	}{
+		{"ranges not honored", noRanges.URL, "", ErrChunkingUnsupported},
+		{"fits one chunk", small.URL, "", ErrChunkingUnsupported},
+		{"range fits one chunk", server.URL, "bytes=0-9999", ErrChunkingUnsupported},
+		{"multiple ranges", server.URL, "bytes=0-10,20-30", ErrChunkingUnsupported},
+		{"suffix range", server.URL, "bytes=-500", ErrChunkingUnsupported},
+		{"start past the end", server.URL, "bytes=200000-", ErrRangeNotSatisfiable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewChunkedFetcher(http.DefaultClient, 4, testChunkSize, 0)
+			_, err := f.Open(context.Background(), &StreamInfo{URL: tt.url}, tt.rangeHeader, nil)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Open error = %v, want %v", err, tt.want)
+			}
+			var rangeErr *RangeError
+			if errors.As(err, &rangeErr) && rangeErr.Total != int64(len(data)) {
+				t.Fatalf("RangeError total = %d, want %d", rangeErr.Total, len(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	unitTimestampPattern = regexp.MustCompile(`^(?:(\d+)h)?(?:(\d+)m)?(?:(\d+(?:\.\d+)?)s)?$`)
+	// Plain decimal seconds; ParseFloat alone would take "NaN", "Inf", "1e9"
+	// and hex floats
+	decimalPattern = regexp.MustCompile(`^\d+(?:\.\d+)?$`)
+)
+
+// ParseTimestamp parses a clip boundary given as seconds ("90", "90.5"),
+// clock time ("1:30", "1:02:03") or YouTube's t= style ("1h2m3s", "90s")
+func ParseTimestamp(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty timestamp")
+	}
+
+	if decimalPattern.MatchString(s) {
+		sec, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		return sec, nil
+	}
+	if strings.HasPrefix(s, "-") {
+		return 0, fmt.Errorf("negative timestamp %q", s)
+	}
+
+	if strings.Contains(s, ":") {
+		parts := strings.Split(s, ":")
+		if len(parts) > 3 {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		var sec float64
+		for i, part := range parts {
+			// Only the seconds may have a fraction
+			if !decimalPattern.MatchString(part) || (i < len(parts)-1 && strings.Contains(part, ".")) {
+				return 0, fmt.Errorf("invalid timestamp %q", s)
+			}
+			v, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid timestamp %q", s)
+			}
+			sec = sec*60 + v
+		}
+		return sec, nil
+	}
+
+	m := unitTimestampPattern.FindStringSubmatch(s)
+	if m == nil || (m[1] == "" && m[2] == "" && m[3] == "") {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	hours, _ := strconv.ParseFloat(m[1], 64)
+	minutes, _ := strconv.ParseFloat(m[2], 64)
+	sec, _ := strconv.ParseFloat(m[3], 64)
+	total := hours*3600 + minutes*60 + sec
+	if math.IsInf(total, 0) {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return total, nil
+}
+
+// StartFromURL returns the start time in a pasted video URL (t= or start=
+// query parameter, or #t= fragment), or 0 when there is none
+func StartFromURL(rawURL string) float64 {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0
+	}
+
+	value := u.Query().Get("t")
+	if value == "" {
+		value = u.Query().Get("start")
+	}
+	if value == "" {
+		if fragment, err := url.ParseQuery(u.Fragment); err == nil {
+			value = fragment.Get("t")
+		}
+	}
+	if value == "" {
+		return 0
+	}
+
+	sec, err := ParseTimestamp(value)
+	if err != nil {
+		return 0
+	}
+	return sec
+}
+
+// formatClipTime formats seconds for filenames, e.g. "1h02m03s" or "45s"
+func formatClipTime(sec float64) string {
+	total := int(sec)
+	h, m, s := total/3600, total%3600/60, total%60
+	switch {
+	case h > 0:
+		return fmt.Sprintf("%dh%02dm%02ds", h, m, s)
+	case m > 0:
+		return fmt.Sprintf("%dm%02ds", m, s)
+	}
+	return fmt.Sprintf("%ds", s)
+}
+
+// formatSeconds formats seconds for yt-dlp arguments
+func formatSeconds(sec float64) string {
+	return strconv.FormatFloat(sec, 'f', -1, 64)
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{"90", 90, false},
+		{"90.5", 90.5, false},
+		{" 0 ", 0, false},
+		{"1:30", 90, false},
+		{"1:02:03.5", 3723.5, false},
+		{"1h2m3s", 3723, false},
+		{"90s", 90, false},
+		{"2m", 120, false},
+
+		{"", 0, true},
+		{"-5", 0, true},
+		{"NaN", 0, true},
+		{"nan", 0, true},
+		{"Inf", 0, true},
+		{"+Inf", 0, true},
+		{"infinity", 0, true},
+		{"1e9", 0, true},
+		{"0x1p10", 0, true},
+		{"+90", 0, true},
+		{".5", 0, true},
+		{"1:NaN", 0, true},
+		{"1:1e3", 0, true},
+		{"1.5:30", 0, true},
+		{"1:2:3:4", 0, true},
+		{"1h2x", 0, true},
+		{"h", 0, true},
+		{"1e400", 0, true},
+		{strings.Repeat("9", 400), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseTimestamp(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTimestamp(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Fatalf("ParseTimestamp(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Errors reported by yt-dlp, recognized from its stderr
+var (
+	ErrVideoUnavailable = errors.New("video unavailable")
+	ErrPrivateVideo     = errors.New("private video")
+	ErrLoginRequired    = errors.New("login required")
+	ErrGeoBlocked       = errors.New("video is geo-blocked")
+	ErrMembersOnly      = errors.New("members-only video")
+	ErrLiveNotStarted   = errors.New("live event has not started")
+	ErrRateLimited      = errors.New("rate limited by upstream")
+)
+
+// ytdlpErrorPatterns maps yt-dlp error messages to sentinel errors. Order
+// matters: YouTube's bot check also says "Sign in", so it must be tested
+// before the generic login patterns.
+var ytdlpErrorPatterns = []struct {
+	pattern *regexp.Regexp
+	kind    error
+}{
+	{regexp.MustCompile(`(?i)confirm you.re not a bot|HTTP Error 429|Too Many Requests|rate-limit reached`), ErrRateLimited},
+	{regexp.MustCompile(`(?i)private video|video is private|account is private`), ErrPrivateVideo},
+	{regexp.MustCompile(`(?i)members[- ]only|join this channel|available to this channel's members`), ErrMembersOnly},
+	{regexp.MustCompile(`(?i)confirm your age|age[- ]restricted|inappropriate for some users`), ErrLoginRequired},
+	{regexp.MustCompile(`(?i)not available in your country|geo[- ]?restrict|blocked it in your country|not made this video available in your country`), ErrGeoBlocked},
+	{regexp.MustCompile(`(?i)live event will begin|premieres in|is upcoming|has not started`), ErrLiveNotStarted},
+	{regexp.MustCompile(`(?i)unsupported url`), ErrUnsupportedURL},
+	{regexp.MustCompile(`(?i)login required|sign in|--cookies|requires authentication`), ErrLoginRequired},
+	{regexp.MustCompile(`(?i)video unavailable|has been removed|does not exist|no longer available|HTTP Error 404`), ErrVideoUnavailable},
+}
+
+// YtDlpError is returned when yt-dlp exits with an error. Kind holds one of
+// the sentinel errors when the message was recognized, so callers can use
+// errors.Is.
+type YtDlpError struct {
+	Op     string
+	Kind   error
+	Stderr string
+}
+
+func (e *YtDlpError) Error() string {
+	msg := e.Stderr
+	if msg == "" && e.Kind != nil {
+		msg = e.Kind.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Op, msg)
+}
+
+func (e *YtDlpError) Unwrap() error {
+	return e.Kind
+}
+
+// ytdlpFailure wraps the error of a finished yt-dlp command. stderr is used
+// when the command's output was not captured in the exit error.
+func ytdlpFailure(op string, err error, stderr []byte) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if len(exitErr.Stderr) > 0 {
+		stderr = exitErr.Stderr
+	}
+	msg := strings.TrimSpace(string(stderr))
+
+	return &YtDlpError{
+		Op:     op,
+		Kind:   classifyYtDlpError(msg),
+		Stderr: msg,
+	}
+}
+
+func classifyYtDlpError(stderr string) error {
+	for _, p := range ytdlpErrorPatterns {
+		if p.pattern.MatchString(stderr) {
+			return p.kind
+		}
+	}
+	return nil
+}
+
+// ErrorCode returns a machine-readable code for errors that clients can act
+// on, or an empty string for unexpected failures
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidURL):
+		return "invalid_url"
+	case errors.Is(err, ErrUnsupportedURL):
+		return "unsupported_url"
+	case errors.Is(err, ErrInvalidOptions):
+		return "invalid_options"
+	case errors.Is(err, ErrInvalidToken):
+		return "invalid_token"
+	case errors.Is(err, ErrTokenExpired):
+		return "token_expired"
+	case errors.Is(err, ErrVideoUnavailable):
+		return "video_unavailable"
+	case errors.Is(err, ErrPrivateVideo):
+		return "private_video"
+	case errors.Is(err, ErrLoginRequired):
+		return "login_required"
+	case errors.Is(err, ErrGeoBlocked):
+		return "geo_blocked"
+	case errors.Is(err, ErrMembersOnly):
+		return "members_only"
+	case errors.Is(err, ErrLiveNotStarted):
+		return "live_not_started"
+	case errors.Is(err, ErrRateLimited):
+		return "upstream_rate_limited"
+	}
+	return ""
+}
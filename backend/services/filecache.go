@@ -0,0 +1,303 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fileCacheEntry struct {
+	Key      string    `json:"key"`
+	Filename string    `json:"filename"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+
+	path string
+	refs int // Pins held by Acquire callers
+}
+
+// FileCache stores finished downloads on disk so repeated requests for the
+// same output skip yt-dlp. Files are content-addressed by a key built from
+// everything that affects the output; each has a JSON sidecar with its
+// metadata so the cache survives restarts. Least recently used files are
+// evicted when the size cap is exceeded, and files older than ttl expire;
+// files pinned by Acquire are kept until released.
+// Use is tracked in the sidecars, never on the files themselves, so a file's
+// mtime stays a stable validator for resumed downloads.
+type FileCache struct {
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	entries map[string]*fileCacheEntry
+	size    int64
+}
+
+// NewFileCache creates a cache in dir holding up to maxBytes. A zero maxBytes
+// disables the cache; a zero ttl keeps files until they are evicted.
+func NewFileCache(dir string, maxBytes int64, ttl time.Duration, logger *slog.Logger) *FileCache {
+	c := &FileCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		logger:   logger,
+		entries:  make(map[string]*fileCacheEntry),
+	}
+	if !c.Enabled() {
+		return c
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logger.Error("Failed to create cache dir, caching disabled", "dir", dir, "error", err)
+		c.maxBytes = 0
+		return c
+	}
+	c.load()
+	go c.cleanupExpired()
+	return c
+}
+
+// Enabled reports whether files are cached at all
+func (c *FileCache) Enabled() bool {
+	return c.maxBytes > 0
+}
+
+// CacheKey builds a cache key from the parts identifying an output
+func CacheKey(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the cached file for key and marks it as recently used
+func (c *FileCache) Get(key string) (path, filename string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.useLocked(key)
+	if entry == nil {
+		return "", "", false
+	}
+	return entry.path, entry.Filename, true
+}
+
+// Acquire is like Get, but pins the file: it is neither evicted nor expired
+// until release is called, so it can be served to the end
+func (c *FileCache) Acquire(key string) (path, filename string, release func(), ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.useLocked(key)
+	if entry == nil {
+		return "", "", nil, false
+	}
+	entry.refs++
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			entry.refs--
+			if entry.refs > 0 || c.entries[entry.Key] != entry {
+				return
+			}
+			// Catch up on what was skipped while pinned
+			if c.expired(entry) {
+				c.removeLocked(entry)
+			}
+			c.evictLocked("")
+		})
+	}
+	return entry.path, entry.Filename, release, true
+}
+
+// useLocked returns the live entry for key, marking it as recently used
+func (c *FileCache) useLocked(key string) *fileCacheEntry {
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if c.expired(entry) && entry.refs == 0 {
+		c.removeLocked(entry)
+		return nil
+	}
+
+	entry.LastUsed = time.Now()
+	// Keep the access time in the sidecar so LRU order survives restarts
+	c.writeMetaLocked(entry)
+	return entry
+}
+
+// Put moves the file at srcPath into the cache and returns its new path. The
+// new file is never evicted by its own insertion, so a single file larger
+// than the cap is kept until the next insertion.
+func (c *FileCache) Put(key, srcPath, filename string) (string, error) {
+	stat, err := os.Stat(srcPath)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(c.dir, key+filepath.Ext(filename))
+	if err := moveFile(srcPath, path); err != nil {
+		return "", fmt.Errorf("failed to move file into cache: %w", err)
+	}
+
+	now := time.Now()
+	entry := &fileCacheEntry{
+		Key:      key,
+		Filename: filename,
+		Size:     stat.Size(),
+		Created:  now,
+		LastUsed: now,
+		path:     path,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.writeMetaLocked(entry); err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("failed to write cache metadata: %w", err)
+	}
+
+	if old, ok := c.entries[key]; ok {
+		c.size -= old.Size
+	}
+	c.entries[key] = entry
+	c.size += entry.Size
+	c.evictLocked(key)
+
+	return path, nil
+}
+
+func (c *FileCache) writeMetaLocked(entry *fileCacheEntry) error {
+	meta, _ := json.Marshal(entry)
+	return os.WriteFile(c.metaPath(entry.Key), meta, 0644)
+}
+
+func (c *FileCache) metaPath(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *FileCache) expired(entry *fileCacheEntry) bool {
+	return c.ttl > 0 && time.Since(entry.Created) > c.ttl
+}
+
+// evictLocked removes least recently used entries, except keep and pinned
+// ones, until the cache fits its cap
+func (c *FileCache) evictLocked(keep string) {
+	for c.size > c.maxBytes {
+		var victim *fileCacheEntry
+		for key, entry := range c.entries {
+			if key == keep || entry.refs > 0 {
+				continue
+			}
+			if victim == nil || entry.LastUsed.Before(victim.LastUsed) {
+				victim = entry
+			}
+		}
+		if victim == nil {
+			return
+		}
+		c.logger.Info("Evicting cached file", "filename", victim.Filename, "size", victim.Size)
+		c.removeLocked(victim)
+	}
+}
+
+func (c *FileCache) removeLocked(entry *fileCacheEntry) {
+	// Clients still streaming the file keep their open descriptor
+	os.Remove(entry.path)
+	os.Remove(c.metaPath(entry.Key))
+	delete(c.entries, entry.Key)
+	c.size -= entry.Size
+}
+
+// load rebuilds the index from the sidecar files in the cache dir
+func (c *FileCache) load() {
+	metas, _ := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	for _, metaPath := range metas {
+		data, err := os.ReadFile(metaPath)
+		if err != nil {
+			continue
+		}
+		var entry fileCacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.Key == "" {
+			os.Remove(metaPath)
+			continue
+		}
+
+		entry.path = filepath.Join(c.dir, entry.Key+filepath.Ext(entry.Filename))
+		stat, err := os.Stat(entry.path)
+		if err != nil {
+			os.Remove(metaPath)
+			continue
+		}
+		entry.Size = stat.Size()
+		if entry.LastUsed.IsZero() {
+			// Sidecars written before use was tracked in them
+			entry.LastUsed = stat.ModTime()
+		}
+
+		c.entries[entry.Key] = &entry
+		c.size += entry.Size
+	}
+
+	c.mu.Lock()
+	c.evictLocked("")
+	c.mu.Unlock()
+
+	c.logger.Info("File cache loaded", "dir", c.dir, "files", len(c.entries), "size", c.size)
+}
+
+func (c *FileCache) cleanupExpired() {
+	for {
+		time.Sleep(time.Minute)
+		c.mu.Lock()
+		for _, entry := range c.entries {
+			if c.expired(entry) && entry.refs == 0 {
+				c.removeLocked(entry)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// moveFile renames src to dst, copying when they are on different filesystems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
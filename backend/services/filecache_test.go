@@ -0,0 +1,113 @@
+package services
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestFileCache(t *testing.T, dir string, maxBytes int64) *FileCache {
+	t.Helper()
+	return NewFileCache(dir, maxBytes, 0, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func putTestFile(t *testing.T, c *FileCache, key string, size int) string {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), key)
+	if err := os.WriteFile(src, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path, err := c.Put(key, src, key+".mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileCacheGetKeepsModTime(t *testing.T) {
+	c := newTestFileCache(t, t.TempDir(), 1<<20)
+	path := putTestFile(t, c, "a", 10)
+	before, _ := os.Stat(path)
+
+	time.Sleep(10 * time.Millisecond)
+	if _, _, ok := c.Get("a"); !ok {
+		t.Fatal("cached file not found")
+	}
+	after, _ := os.Stat(path)
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Fatalf("Get changed mtime from %v to %v", before.ModTime(), after.ModTime())
+	}
+}
+
+func TestFileCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestFileCache(t, dir, 25)
+	putTestFile(t, c, "a", 10)
+	time.Sleep(5 * time.Millisecond)
+	putTestFile(t, c, "b", 10)
+	time.Sleep(5 * time.Millisecond)
+	c.Get("a")
+
+	// Order survives a restart through the sidecars
+	c = newTestFileCache(t, dir, 25)
+	putTestFile(t, c, "c", 10)
+
+	if _, _, ok := c.Get("b"); ok {
+		t.Fatal("b should have been evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, _, ok := c.Get(key); !ok {
+			t.Fatalf("%s should still be cached", key)
+		}
+	}
+}
+
+func TestFileCacheAcquirePinsFile(t *testing.T) {
+	c := newTestFileCache(t, t.TempDir(), 15)
+	path := putTestFile(t, c, "a", 10)
+	_, _, release, ok := c.Acquire("a")
+	if !ok {
+		t.Fatal("cached file not found")
+	}
+
+	// Over the cap, but the only other file is pinned
+	time.Sleep(5 * time.Millisecond)
+	putTestFile(t, c, "b", 10)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("pinned file was evicted: %v", err)
+	}
+
+	// Releasing the last pin catches up on the eviction
+	release()
+	release()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("released file should have been evicted")
+	}
+	if _, _, ok := c.Get("b"); !ok {
+		t.Fatal("b should still be cached")
+	}
+}
+
+func TestFileCacheAcquireDefersExpiry(t *testing.T) {
+	c := NewFileCache(t.TempDir(), 1<<20, 20*time.Millisecond, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	path := putTestFile(t, c, "a", 10)
+	_, _, release, ok := c.Acquire("a")
+	if !ok {
+		t.Fatal("cached file not found")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, _, ok := c.Get("a"); !ok {
+		t.Fatal("pinned file expired")
+	}
+	release()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("expired file should be removed once released")
+	}
+	if _, _, ok := c.Get("a"); ok {
+		t.Fatal("expired file is still cached")
+	}
+}
@@ -0,0 +1,231 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// MergedStream merges separate video and audio streams on the fly with
+// ffmpeg into fragmented MP4, so bytes reach the client while the source is
+// still downloading. Fragmented MP4 needs no seekable output, at the cost of
+// an unknown Content-Length and no range support. A complete stream is also
+// stored in the file cache, so repeated requests are served from disk.
+type MergedStream struct {
+	Filename string
+
+	videoURL string
+	audioURL string
+	headers  map[string]string
+	cacheKey string // Empty when the file cache is disabled
+	s        *YtDlpService
+}
+
+// OpenMergedStream resolves the video and audio URLs for a merged format
+func (s *YtDlpService) OpenMergedStream(ctx context.Context, url, formatID string) (*MergedStream, error) {
+	videoURL, audioURL, filename, headers, err := s.GetDirectURLs(ctx, url, formatID)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &MergedStream{
+		Filename: filename,
+		videoURL: videoURL,
+		audioURL: audioURL,
+		headers:  headers,
+		s:        s,
+	}
+	if s.files.Enabled() {
+		if m.cacheKey, err = s.outputCacheKey(url, formatID, DownloadOptions{}); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// WriteTo fetches both streams through the configured proxy, pipes them into
+// ffmpeg and writes the fragmented MP4 to w. It returns the number of bytes
+// written, so callers can still fall back to another strategy when nothing
+// has been sent yet. A source stream that breaks off fails the merge instead
+// of ending the file early.
+func (m *MergedStream) WriteTo(ctx context.Context, w io.Writer) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	video, err := m.s.fetch(ctx, m.videoURL, m.headers)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch video stream: %w", err)
+	}
+	defer video.Close()
+
+	audio, err := m.s.fetch(ctx, m.audioURL, m.headers)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch audio stream: %w", err)
+	}
+	defer audio.Close()
+
+	var cacheFile *os.File
+	if m.cacheKey != "" {
+		cacheFile, err = createTempFile("fmp4_*.mp4")
+		if err != nil {
+			m.s.files.logger.Warn("Failed to create cache file, streaming without caching", "error", err)
+		} else {
+			defer os.Remove(cacheFile.Name())
+			defer cacheFile.Close()
+			w = io.MultiWriter(w, cacheFile)
+		}
+	}
+
+	// ffmpeg reads the inputs from fds 3 and 4 (ExtraFiles)
+	videoPipeR, videoPipeW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	audioPipeR, audioPipeW, err := os.Pipe()
+	if err != nil {
+		videoPipeR.Close()
+		videoPipeW.Close()
+		return 0, err
+	}
+
+	counter := &countingWriter{w: w}
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, m.s.ffmpegPath,
+		"-hide_banner",
+		"-loglevel", "error",
+		"-i", "pipe:3",
+		"-i", "pipe:4",
+		"-map", "0:v:0",
+		"-map", "1:a:0",
+		"-c:v", "copy",
+		"-c:a", "aac",
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"-f", "mp4",
+		"pipe:1",
+	)
+	cmd.ExtraFiles = []*os.File{videoPipeR, audioPipeR}
+	cmd.Stdout = counter
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+
+	if err := cmd.Start(); err != nil {
+		videoPipeR.Close()
+		videoPipeW.Close()
+		audioPipeR.Close()
+		audioPipeW.Close()
+		return 0, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	// The child has its own copies of the read ends
+	videoPipeR.Close()
+	audioPipeR.Close()
+
+	pumpErrs := make(chan error, 2)
+	for _, input := range []struct {
+		name string
+		dst  *os.File
+		src  io.Reader
+	}{{"video", videoPipeW, video}, {"audio", audioPipeW, audio}} {
+		go func() {
+			err := pump(input.dst, input.src)
+			if err != nil {
+				// Kill ffmpeg rather than let it finalize a truncated file
+				cancel()
+				err = fmt.Errorf("%s stream broke off: %w", input.name, err)
+			}
+			pumpErrs <- err
+		}()
+	}
+
+	waitErr := cmd.Wait()
+	// Unblock a pump still reading after ffmpeg exited
+	cancel()
+	var pumpErr error
+	for range 2 {
+		if err := <-pumpErrs; err != nil && pumpErr == nil {
+			pumpErr = err
+		}
+	}
+	if pumpErr != nil {
+		return counter.n, pumpErr
+	}
+	if waitErr != nil {
+		return counter.n, fmt.Errorf("ffmpeg failed: %w: %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+
+	if cacheFile != nil {
+		m.store(cacheFile)
+	}
+	return counter.n, nil
+}
+
+// store moves a complete stream into the file cache
+func (m *MergedStream) store(f *os.File) {
+	if err := f.Close(); err != nil {
+		m.s.files.logger.Warn("Failed to write cache file", "error", err)
+		return
+	}
+	if _, err := m.s.files.Put(m.cacheKey, f.Name(), m.Filename); err != nil {
+		m.s.files.logger.Warn("Failed to cache merged stream", "error", err)
+	}
+}
+
+// fetch opens a CDN URL through the service's HTTP client, with the headers
+// yt-dlp says the CDN expects
+func (s *YtDlpService) fetch(ctx context.Context, url string, headers map[string]string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// pump copies a source stream into an ffmpeg input pipe and closes it, which
+// ffmpeg sees as end of input. It returns the error reading src; a failed
+// write means ffmpeg exited, which its own exit status reports.
+func pump(dst *os.File, src io.Reader) error {
+	defer dst.Close()
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,66 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+type brokenReader struct {
+	data string
+	err  error
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestPump(t *testing.T) {
+	reset := errors.New("connection reset")
+	tests := []struct {
+		name    string
+		src     io.Reader
+		wantErr error
+	}{
+		{"complete", strings.NewReader("frames"), nil},
+		{"broken off", &brokenReader{data: "fra", err: reset}, reset},
+		{"truncated body", &brokenReader{data: "fra", err: io.ErrUnexpectedEOF}, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			done := make(chan error, 1)
+			go func() { done <- pump(w, tt.src) }()
+			if _, err := io.ReadAll(r); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-done; !errors.Is(err, tt.wantErr) {
+				t.Fatalf("pump() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPumpIgnoresClosedPipe(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ffmpeg exited: its exit status is the error to report
+	r.Close()
+	if err := pump(w, strings.NewReader("frames")); err != nil {
+		t.Fatalf("pump() = %v, want nil", err)
+	}
+}
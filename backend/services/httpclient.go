@@ -0,0 +1,38 @@
+package services
+
+import (
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// NewHTTPClient creates an HTTP client for fetching media from CDNs, routed
+// through the configured SOCKS5 or HTTP proxy
+func NewHTTPClient(proxyURL string) *http.Client {
+	transport := &http.Transport{}
+
+	if proxyURL != "" {
+		proxyParsed, err := url.Parse(proxyURL)
+		if err == nil && (proxyParsed.Scheme == "socks5" || proxyParsed.Scheme == "socks5h") {
+			// SOCKS5 proxy
+			auth := &proxy.Auth{}
+			if proxyParsed.User != nil {
+				auth.User = proxyParsed.User.Username()
+				auth.Password, _ = proxyParsed.User.Password()
+			}
+			dialer, err := proxy.SOCKS5("tcp", proxyParsed.Host, auth, proxy.Direct)
+			if err == nil {
+				transport.Dial = dialer.Dial
+			}
+		} else if err == nil && (proxyParsed.Scheme == "http" || proxyParsed.Scheme == "https") {
+			// HTTP proxy
+			transport.Proxy = http.ProxyURL(proxyParsed)
+		}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   0, // No timeout for streaming
+	}
+}
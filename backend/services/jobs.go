@@ -0,0 +1,356 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+type JobState string
+
+const (
+	JobQueued      JobState = "queued"
+	JobExtracting  JobState = "extracting"
+	JobDownloading JobState = "downloading"
+	JobMerging     JobState = "merging"
+	JobTranscoding JobState = "transcoding"
+	JobReady       JobState = "ready"
+	JobFailed      JobState = "failed"
+	JobCanceled    JobState = "canceled"
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobNotReady = errors.New("job not ready")
+)
+
+// jobTimeout bounds a single job run, matching the server's write timeout
+const jobTimeout = 6 * time.Hour
+
+// JobRequest describes what a download job should fetch
+type JobRequest struct {
+	URL      string
+	FormatID string
+	Type     string // Format type; "audio" files are served as audio
+	Options  DownloadOptions
+	Client   string // Identity used for queue fairness
+}
+
+// Job is a snapshot of a background download
+type Job struct {
+	ID        string          `json:"id"`
+	State     JobState        `json:"state"`
+	URL       string          `json:"url"`
+	FormatID  string          `json:"format_id"`
+	Type      string          `json:"type"`
+	Options   DownloadOptions `json:"options"`
+	Filename  string          `json:"filename,omitempty"`
+	Size      int64           `json:"size,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	ErrorCode string          `json:"error_code,omitempty"`
+	Position  int             `json:"position,omitempty"` // Place in the download queue while queued
+	Progress  *Progress       `json:"progress,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+
+	client   string
+	cancel   context.CancelFunc
+	filePath string
+	fileKey  string // Output key, see DownloadToFile
+	cleanup  func()
+}
+
+// JobManager runs downloads in the background so clients don't have to hold
+// a request open for the whole yt-dlp run
+type JobManager struct {
+	ytdlp  *YtDlpService
+	queue  *AdmissionQueue
+	logger *slog.Logger
+	ttl    time.Duration
+
+	mu          sync.RWMutex
+	jobs        map[string]*Job
+	subscribers map[string]map[chan *Job]struct{}
+}
+
+// NewJobManager creates a job manager; finished jobs and their files are
+// removed once they are older than ttl
+func NewJobManager(ytdlp *YtDlpService, queue *AdmissionQueue, logger *slog.Logger, ttl time.Duration) *JobManager {
+	m := &JobManager{
+		ytdlp:       ytdlp,
+		queue:       queue,
+		logger:      logger,
+		ttl:         ttl,
+		jobs:        make(map[string]*Job),
+		subscribers: make(map[string]map[chan *Job]struct{}),
+	}
+	go m.cleanupJobs()
+	return m
+}
+
+// Create validates the request and queues a new job
+func (m *JobManager) Create(req JobRequest) (*Job, error) {
+	if _, err := m.ytdlp.mediaRef(req.URL); err != nil {
+		return nil, err
+	}
+	if err := m.ytdlp.ValidateOptions(req.Options); err != nil {
+		return nil, err
+	}
+	if req.FormatID == "" {
+		req.FormatID = "best"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+
+	now := time.Now()
+	job := &Job{
+		ID:        newJobID(),
+		State:     JobQueued,
+		URL:       req.URL,
+		FormatID:  req.FormatID,
+		Type:      req.Type,
+		Options:   req.Options,
+		CreatedAt: now,
+		UpdatedAt: now,
+		client:    req.Client,
+		cancel:    cancel,
+	}
+
+	m.mu.Lock()
+	m.jobs[job.ID] = job
+	m.mu.Unlock()
+
+	go m.run(ctx, cancel, job.ID, req.Client)
+
+	return m.snapshot(job), nil
+}
+
+// Get returns a snapshot of the job
+func (m *JobManager) Get(id string) (*Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return m.snapshot(job), nil
+}
+
+// File returns the path and output key of the finished download along with
+// the job snapshot
+func (m *JobManager) File(id string) (path, key string, job *Job, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	j, ok := m.jobs[id]
+	if !ok {
+		return "", "", nil, ErrJobNotFound
+	}
+	if j.State != JobReady {
+		return "", "", m.snapshot(j), ErrJobNotReady
+	}
+	return j.filePath, j.fileKey, m.snapshot(j), nil
+}
+
+// Subscribe returns a channel receiving a snapshot after every change of the
+// job. Only the latest snapshot is buffered, so slow readers skip updates
+// instead of blocking the download. The returned func must be called to
+// unsubscribe.
+func (m *JobManager) Subscribe(id string) (<-chan *Job, func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, nil, ErrJobNotFound
+	}
+
+	ch := make(chan *Job, 1)
+	ch <- m.snapshot(job)
+	if m.subscribers[id] == nil {
+		m.subscribers[id] = make(map[chan *Job]struct{})
+	}
+	m.subscribers[id][ch] = struct{}{}
+
+	unsubscribe := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.subscribers[id], ch)
+		if len(m.subscribers[id]) == 0 {
+			delete(m.subscribers, id)
+		}
+	}
+	return ch, unsubscribe, nil
+}
+
+// Cancel stops a job, removing it from the queue if it hasn't started yet.
+// The file of a finished job is deleted.
+func (m *JobManager) Cancel(id string) error {
+	m.mu.RLock()
+	job, ok := m.jobs[id]
+	m.mu.RUnlock()
+	if !ok {
+		return ErrJobNotFound
+	}
+
+	job.cancel()
+	m.update(id, func(j *Job) {
+		if j.cleanup != nil {
+			j.cleanup()
+		}
+		j.State = JobCanceled
+		j.Position = 0
+		j.filePath = ""
+		j.cleanup = nil
+	})
+	return nil
+}
+
+// Finished reports whether the job reached a terminal state
+func (j *Job) Finished() bool {
+	return j.State == JobReady || j.State == JobFailed || j.State == JobCanceled
+}
+
+// run waits for a slot in the queue as client, since snapshots don't carry
+// the client, and downloads the job
+func (m *JobManager) run(ctx context.Context, cancel context.CancelFunc, id, client string) {
+	defer cancel()
+	job, _ := m.Get(id)
+
+	release, err := m.queue.Acquire(ctx, client, func(position int) {
+		m.update(id, func(j *Job) { j.Position = position })
+	})
+	if err != nil {
+		m.logger.Warn("Job not admitted", "job", id, "error", err)
+		m.update(id, func(j *Job) {
+			j.State = JobFailed
+			j.Position = 0
+			j.Error = "Сервер занят. Попробуйте позже."
+		})
+		return
+	}
+	defer release()
+
+	m.update(id, func(j *Job) {
+		j.State = JobExtracting
+		j.Position = 0
+	})
+	m.logger.Info("Job started", "job", id, "url", job.URL, "format", job.FormatID)
+	startTime := time.Now()
+
+	// DownloadToFile handles single formats too; yt-dlp only merges when the
+	// format selector asks for it
+	tempPath, filename, key, cleanup, err := m.ytdlp.DownloadToFile(ctx, job.URL, job.FormatID, job.Options, func(p Progress) {
+		m.update(id, func(j *Job) {
+			switch p.Phase {
+			case PhaseVideo, PhaseAudio:
+				j.State = JobDownloading
+			case PhaseMerge, PhasePostprocess:
+				j.State = JobMerging
+			case PhaseTranscode:
+				j.State = JobTranscoding
+			}
+			j.Progress = &p
+		})
+	})
+	if err != nil {
+		m.logger.Error("Job failed", "job", id, "error", err)
+		m.update(id, func(j *Job) {
+			j.State = JobFailed
+			j.Error = "Download failed"
+			j.ErrorCode = ErrorCode(err)
+		})
+		return
+	}
+
+	var size int64
+	if info, err := os.Stat(tempPath); err == nil {
+		size = info.Size()
+	}
+
+	if ctx.Err() != nil {
+		cleanup()
+		return
+	}
+
+	ready := m.update(id, func(j *Job) {
+		j.State = JobReady
+		j.Filename = filename
+		j.Size = size
+		j.filePath = tempPath
+		j.fileKey = key
+		j.cleanup = cleanup
+	})
+	if !ready {
+		// Canceled just as the download finished
+		cleanup()
+		return
+	}
+	m.logger.Info("Job ready", "job", id, "filename", filename, "size", size, "duration", time.Since(startTime))
+}
+
+// update applies fn to the job and notifies subscribers. It reports false
+// when the job is gone or canceled, in which case fn isn't applied.
+func (m *JobManager) update(id string, fn func(j *Job)) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok || job.State == JobCanceled {
+		return false
+	}
+	fn(job)
+	job.UpdatedAt = time.Now()
+
+	for ch := range m.subscribers[id] {
+		// Replace a pending snapshot nobody has read yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- m.snapshot(job)
+	}
+	return true
+}
+
+func (m *JobManager) snapshot(job *Job) *Job {
+	c := *job
+	c.client = ""
+	c.cancel = nil
+	c.filePath = ""
+	c.fileKey = ""
+	c.cleanup = nil
+	if job.Progress != nil {
+		p := *job.Progress
+		c.Progress = &p
+	}
+	return &c
+}
+
+func (m *JobManager) cleanupJobs() {
+	for {
+		time.Sleep(time.Minute)
+		m.mu.Lock()
+		for id, job := range m.jobs {
+			if job.Finished() && time.Since(job.UpdatedAt) > m.ttl {
+				if job.cleanup != nil {
+					job.cleanup()
+				}
+				delete(m.jobs, id)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,73 @@
+package services
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestJobManager runs jobs with a yt-dlp stand-in that never finishes, so
+// admitted jobs keep their slots until canceled
+func newTestJobManager(t *testing.T, queue *AdmissionQueue) *JobManager {
+	t.Helper()
+	ytdlp := filepath.Join(t.TempDir(), "yt-dlp")
+	if err := os.WriteFile(ytdlp, []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := NewYtDlpService(ytdlp, "ffmpeg", "", "", NewValidator(), NewAnalyzeCache(time.Minute, 10),
+		NewFileCache(t.TempDir(), 0, 0, logger), nil, nil)
+	return NewJobManager(s, queue, logger, time.Hour)
+}
+
+func waitJob(t *testing.T, m *JobManager, id string, done func(j *Job) bool) *Job {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		job, err := m.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done(job) {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s stuck in %+v", id, job)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestJobManagerAdmitsClientsSideBySide(t *testing.T) {
+	m := newTestJobManager(t, NewAdmissionQueue(3, 1, 0, 0))
+	const url = "https://www.youtube.com/watch?v=dQw4w9WgXcQ"
+
+	var ids []string
+	t.Cleanup(func() {
+		for _, id := range ids {
+			m.Cancel(id)
+		}
+	})
+	create := func(client string) string {
+		job, err := m.Create(JobRequest{URL: url, Client: client})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+		return job.ID
+	}
+	started := func(j *Job) bool { return j.State == JobExtracting }
+
+	waitJob(t, m, create("203.0.113.1"), started)
+	waitJob(t, m, create("203.0.113.2"), started)
+
+	// A slot is free, but the first client is at its limit
+	second := create("203.0.113.1")
+	job := waitJob(t, m, second, func(j *Job) bool { return j.Position == 1 })
+	if job.State != JobQueued {
+		t.Fatalf("second job of a client = %s, want queued", job.State)
+	}
+}
@@ -0,0 +1,249 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"unicode"
+)
+
+var ErrInvalidOptions = errors.New("invalid download options")
+
+// AudioFormat is a target of audio conversion
+type AudioFormat struct {
+	Ext         string
+	ContentType string
+	Lossless    bool
+	CoverArt    bool // Whether yt-dlp can embed a thumbnail into the container
+}
+
+// AudioFormats are the audio conversions offered, keyed by yt-dlp's
+// --audio-format name
+var AudioFormats = map[string]AudioFormat{
+	"mp3":  {Ext: "mp3", ContentType: "audio/mpeg", CoverArt: true},
+	"m4a":  {Ext: "m4a", ContentType: "audio/mp4", CoverArt: true},
+	"opus": {Ext: "opus", ContentType: "audio/ogg", CoverArt: true},
+	"flac": {Ext: "flac", ContentType: "audio/flac", Lossless: true, CoverArt: true},
+	"wav":  {Ext: "wav", ContentType: "audio/wav", Lossless: true},
+}
+
+// coverArtArgs convert the thumbnail to JPEG cropped to a centered square,
+// as music players expect
+const coverArtArgs = `ThumbnailsConvertor+ffmpeg_o:-c:v mjpeg -qmin 1 -qscale:v 1 -vf crop="'if(gt(ih,iw),iw,ih)':'if(gt(iw,ih),ih,iw)'"`
+
+const maxTagLength = 256
+
+var tagDatePattern = regexp.MustCompile(`^\d{4}(\d{4})?$`)
+
+// Tags are metadata tags written into the file. Empty fields keep the
+// values yt-dlp derives from the video.
+type Tags struct {
+	Title  string `json:"title,omitempty"`
+	Artist string `json:"artist,omitempty"` // Falls back to the uploader
+	Album  string `json:"album,omitempty"`
+	Date   string `json:"date,omitempty"` // YYYYMMDD or YYYY
+	Track  int    `json:"track,omitempty"`
+}
+
+// IsZero reports whether no tag is set
+func (t Tags) IsZero() bool {
+	return t == Tags{}
+}
+
+func (t Tags) validate() error {
+	for _, value := range []string{t.Title, t.Artist, t.Album} {
+		if len(value) > maxTagLength {
+			return fmt.Errorf("%w: tags must be at most %d bytes", ErrInvalidOptions, maxTagLength)
+		}
+		for _, r := range value {
+			if unicode.IsControl(r) {
+				return fmt.Errorf("%w: tags must not contain control characters", ErrInvalidOptions)
+			}
+		}
+	}
+	if t.Date != "" && !tagDatePattern.MatchString(t.Date) {
+		return fmt.Errorf("%w: tag date must be YYYYMMDD or YYYY", ErrInvalidOptions)
+	}
+	if t.Track < 0 || t.Track > 9999 {
+		return fmt.Errorf("%w: invalid track number", ErrInvalidOptions)
+	}
+	return nil
+}
+
+// metaFields returns the overrides as meta_* info fields, which yt-dlp's
+// FFmpegMetadata prefers over the fields it derives tags from
+func (t Tags) metaFields() map[string]any {
+	fields := make(map[string]any)
+	if t.Title != "" {
+		fields["meta_title"] = t.Title
+	}
+	if t.Artist != "" {
+		fields["meta_artist"] = t.Artist
+	}
+	if t.Album != "" {
+		fields["meta_album"] = t.Album
+	}
+	if t.Date != "" {
+		fields["meta_date"] = t.Date
+	}
+	if t.Track != 0 {
+		fields["meta_track"] = strconv.Itoa(t.Track)
+	}
+	return fields
+}
+
+// Bitrate bounds for lossy audio conversion, kbps
+const (
+	minAudioBitrate = 32
+	maxAudioBitrate = 320
+)
+
+// DownloadOptions describe how a download is processed after fetching. The
+// zero value keeps the source as is.
+type DownloadOptions struct {
+	AudioFormat  string `json:"audio_format,omitempty"`  // Convert to this AudioFormats entry
+	AudioBitrate int    `json:"audio_bitrate,omitempty"` // Target kbps for lossy formats, 0 for the encoder default
+
+	// EmbedMetadata writes title, artist, album, date and track tags, and
+	// square cover art for audio formats that support it
+	EmbedMetadata bool `json:"embed_metadata,omitempty"`
+	Tags          Tags `json:"tags,omitzero"` // Overrides, require EmbedMetadata
+
+	// Clip boundaries in seconds; End 0 means the end of the video. Cuts are
+	// fast but snap to keyframes, unless PreciseCut re-encodes around them.
+	Start      float64 `json:"start,omitempty"`
+	End        float64 `json:"end,omitempty"`
+	PreciseCut bool    `json:"precise_cut,omitempty"`
+
+	// Chapter downloads the chapter with this number as a clip;
+	// SplitChapters downloads every chapter as a separate file in a zip
+	Chapter       int  `json:"chapter,omitempty"`
+	SplitChapters bool `json:"split_chapters,omitempty"`
+
+	// Subtitles is a comma-separated list of languages, delivered as set by
+	// SubtitleMode: embedded into the video or as standalone files
+	Subtitles    string `json:"subtitles,omitempty"`
+	SubtitleMode string `json:"subtitle_mode,omitempty"`
+
+	// Preset transcodes to a named output profile; it also picks the source
+	// format
+	Preset string `json:"preset,omitempty"`
+
+	// Convert remuxes or transcodes a video stream to MP4, as flagged by
+	// Format.Conversion
+	Convert string `json:"convert,omitempty"`
+
+	chapterTitle string // Set when Chapter is resolved
+}
+
+// Clip reports whether only a section of the video is downloaded
+func (o DownloadOptions) Clip() bool {
+	return o.Start > 0 || o.End > 0
+}
+
+// Validate checks the options against the supported values
+func (o DownloadOptions) Validate() error {
+	if o.AudioFormat != "" {
+		format, ok := AudioFormats[o.AudioFormat]
+		if !ok {
+			return fmt.Errorf("%w: unsupported audio format %q", ErrInvalidOptions, o.AudioFormat)
+		}
+		if format.Lossless && o.AudioBitrate != 0 {
+			return fmt.Errorf("%w: bitrate not supported for %s", ErrInvalidOptions, o.AudioFormat)
+		}
+	} else if o.AudioBitrate != 0 {
+		return fmt.Errorf("%w: audio_bitrate requires audio_format", ErrInvalidOptions)
+	}
+	if o.AudioBitrate != 0 && (o.AudioBitrate < minAudioBitrate || o.AudioBitrate > maxAudioBitrate) {
+		return fmt.Errorf("%w: audio bitrate must be between %d and %d kbps", ErrInvalidOptions, minAudioBitrate, maxAudioBitrate)
+	}
+	if !o.Tags.IsZero() && !o.EmbedMetadata {
+		return fmt.Errorf("%w: tags require embed_metadata", ErrInvalidOptions)
+	}
+	if o.Start < 0 || o.End < 0 || (o.End > 0 && o.End <= o.Start) {
+		return fmt.Errorf("%w: clip end must be after its start", ErrInvalidOptions)
+	}
+	if o.Chapter < 0 || (o.Chapter > 0 && o.SplitChapters) {
+		return fmt.Errorf("%w: invalid chapter selection", ErrInvalidOptions)
+	}
+	if o.Clip() && (o.Chapter > 0 || o.SplitChapters) {
+		return fmt.Errorf("%w: chapters can't be combined with start or end", ErrInvalidOptions)
+	}
+	if o.PreciseCut && !o.Clip() && o.Chapter == 0 && !o.SplitChapters {
+		return fmt.Errorf("%w: precise_cut requires start, end or chapters", ErrInvalidOptions)
+	}
+	if err := o.validateSubtitles(); err != nil {
+		return err
+	}
+	if err := o.validateConvert(); err != nil {
+		return err
+	}
+	if o.Preset != "" && (o.AudioFormat != "" || o.SplitChapters || o.SubtitlesOnly()) {
+		return fmt.Errorf("%w: presets can't be combined with audio conversion, split chapters or standalone subtitles", ErrInvalidOptions)
+	}
+	return o.Tags.validate()
+}
+
+// clipSuffix is appended to the filename of clips, e.g. " (1m30s-2m00s)"
+func (o DownloadOptions) clipSuffix() string {
+	if !o.Clip() {
+		return ""
+	}
+	end := "end"
+	if o.End > 0 {
+		end = formatClipTime(o.End)
+	}
+	return " (" + formatClipTime(o.Start) + "-" + end + ")"
+}
+
+// NeedsProcessing reports whether the output differs from the source stream,
+// so it can't be proxied from the CDN directly
+func (o DownloadOptions) NeedsProcessing() bool {
+	return o != DownloadOptions{}
+}
+
+// args returns the yt-dlp arguments applying the options
+func (o DownloadOptions) args() []string {
+	var args []string
+	if o.Clip() {
+		end := "inf"
+		if o.End > 0 {
+			end = formatSeconds(o.End)
+		}
+		args = append(args, "--download-sections", "*"+formatSeconds(o.Start)+"-"+end)
+	}
+	if o.SplitChapters {
+		args = append(args, "--split-chapters")
+	}
+	if o.PreciseCut {
+		args = append(args, "--force-keyframes-at-cuts")
+	}
+	args = append(args, o.subtitleArgs()...)
+	args = append(args, o.convertArgs()...)
+	if o.AudioFormat != "" {
+		args = append(args, "--extract-audio", "--audio-format", o.AudioFormat)
+		if o.AudioBitrate > 0 {
+			args = append(args, "--audio-quality", strconv.Itoa(o.AudioBitrate)+"K")
+		}
+	}
+	if o.EmbedMetadata {
+		args = append(args, "--embed-metadata")
+		if AudioFormats[o.AudioFormat].CoverArt {
+			args = append(args,
+				"--embed-thumbnail",
+				"--convert-thumbnails", "jpg",
+				"--postprocessor-args", coverArtArgs,
+			)
+		}
+	}
+	return args
+}
+
+// cacheKey identifies the options in file cache keys
+func (o DownloadOptions) cacheKey() string {
+	return fmt.Sprintf("audio=%s/%d meta=%t/%q/%q/%q/%s/%d clip=%s-%s/%t chapters=%d/%t subs=%s/%s preset=%s convert=%s", o.AudioFormat, o.AudioBitrate,
+		o.EmbedMetadata, o.Tags.Title, o.Tags.Artist, o.Tags.Album, o.Tags.Date, o.Tags.Track,
+		formatSeconds(o.Start), formatSeconds(o.End), o.PreciseCut, o.Chapter, o.SplitChapters,
+		o.Subtitles, o.SubtitleMode, o.Preset, o.Convert)
+}
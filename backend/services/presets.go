@@ -0,0 +1,276 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Preset is a named output profile for messengers and devices. The best
+// source within MaxHeight is transcoded to H.264 (or H.265) with AAC audio;
+// with MaxSizeMB set, the video bitrate is computed from the duration and a
+// two-pass encode hits the size, otherwise a constant quality encode is used.
+// MaxVideoBitrate caps the computed bitrate, or the peak bitrate of a
+// constant quality encode.
+type Preset struct {
+	Name            string `json:"name"`
+	Label           string `json:"label"`
+	MaxSizeMB       int64  `json:"max_size_mb,omitempty"`
+	MaxHeight       int    `json:"max_height,omitempty"`
+	VideoCodec      string `json:"video_codec"`                 // h264 or h265
+	Profile         string `json:"profile,omitempty"`           // e.g. "main" for old devices
+	Level           string `json:"level,omitempty"`             // e.g. "3.1"
+	MaxVideoBitrate int    `json:"max_video_bitrate,omitempty"` // kbps
+	AudioBitrate    int    `json:"audio_bitrate"`               // kbps
+	CRF             int    `json:"crf,omitempty"`               // Quality without MaxSizeMB
+}
+
+// DefaultPresets are used when no presets file is configured
+var DefaultPresets = []Preset{
+	{Name: "telegram", Label: "Telegram (до 2 ГБ, H.264)", MaxSizeMB: 2000, MaxHeight: 1080, VideoCodec: "h264", MaxVideoBitrate: 8000, AudioBitrate: 192},
+	{Name: "whatsapp", Label: "WhatsApp (до 16 МБ)", MaxSizeMB: 16, MaxHeight: 480, VideoCodec: "h264", Profile: "main", MaxVideoBitrate: 1500, AudioBitrate: 96},
+	{Name: "iphone", Label: "iPhone (H.264/AAC)", MaxHeight: 1080, VideoCodec: "h264", Profile: "high", Level: "4.1", AudioBitrate: 160, CRF: 23},
+	{Name: "email", Label: "Email (до 25 МБ)", MaxSizeMB: 25, MaxHeight: 720, VideoCodec: "h264", MaxVideoBitrate: 2500, AudioBitrate: 128},
+}
+
+// Encoders for the preset video codecs
+var presetEncoders = map[string][]string{
+	"h264": {"-c:v", "libx264"},
+	"h265": {"-c:v", "libx265", "-tag:v", "hvc1"}, // hvc1 so Apple devices play it
+}
+
+const (
+	minVideoBitrate = 100 // kbps; below this a size-limited encode is pointless
+	sizeMargin      = 0.97
+	defaultCRF      = 23
+)
+
+// LoadPresets reads presets from a JSON file holding an array of Preset. An
+// empty path returns DefaultPresets.
+func LoadPresets(path string) ([]Preset, error) {
+	if path == "" {
+		return DefaultPresets, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read presets: %w", err)
+	}
+	var presets []Preset
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return nil, fmt.Errorf("failed to parse presets: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range presets {
+		if p.Name == "" || seen[p.Name] {
+			return nil, fmt.Errorf("preset names must be unique and not empty")
+		}
+		if _, ok := presetEncoders[p.VideoCodec]; !ok {
+			return nil, fmt.Errorf("preset %s: unsupported video codec %q", p.Name, p.VideoCodec)
+		}
+		if p.AudioBitrate <= 0 {
+			return nil, fmt.Errorf("preset %s: audio_bitrate is required", p.Name)
+		}
+		seen[p.Name] = true
+	}
+	return presets, nil
+}
+
+// preset returns the preset named name
+func (s *YtDlpService) preset(name string) (*Preset, error) {
+	for i := range s.presets {
+		if s.presets[i].Name == name {
+			return &s.presets[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown preset %q", ErrInvalidOptions, name)
+}
+
+// formatSelector picks the best source within the preset's height,
+// preferring H.264 since it decodes fastest
+func (p *Preset) formatSelector() string {
+	if p.MaxHeight == 0 {
+		return "bv*[vcodec^=avc1]+ba/bv*+ba/b"
+	}
+	h := strconv.Itoa(p.MaxHeight)
+	return "bv*[height<=" + h + "][vcodec^=avc1]+ba/bv*[height<=" + h + "]+ba/b[height<=" + h + "]/b"
+}
+
+// videoBitrate computes the video bitrate (kbps) that makes duration seconds
+// fit MaxSizeMB along with the audio, or 0 for a constant quality encode.
+// Sizes are decimal megabytes, as in the preset labels.
+func (p *Preset) videoBitrate(duration float64) (int, error) {
+	if p.MaxSizeMB == 0 {
+		return 0, nil
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("%w: duration unknown, can't fit preset %s", ErrInvalidOptions, p.Name)
+	}
+
+	totalKbps := float64(p.MaxSizeMB) * 1000 * 1000 * 8 * sizeMargin / duration / 1000
+	videoKbps := int(totalKbps) - p.AudioBitrate
+	if videoKbps < minVideoBitrate {
+		return 0, fmt.Errorf("%w: video is too long for the %d MB of preset %s", ErrInvalidOptions, p.MaxSizeMB, p.Name)
+	}
+	if p.MaxVideoBitrate > 0 && videoKbps > p.MaxVideoBitrate {
+		videoKbps = p.MaxVideoBitrate
+	}
+	return videoKbps, nil
+}
+
+// rateArgs returns the rate control args: the target bitrate for a two-pass
+// encode, or constant quality when bitrate is 0, capped at MaxVideoBitrate
+// with a two second buffer
+func (p *Preset) rateArgs(bitrate int) []string {
+	if bitrate > 0 {
+		return []string{"-b:v", strconv.Itoa(bitrate) + "k"}
+	}
+	crf := p.CRF
+	if crf == 0 {
+		crf = defaultCRF
+	}
+	args := []string{"-crf", strconv.Itoa(crf)}
+	if p.MaxVideoBitrate > 0 {
+		args = append(args,
+			"-maxrate", strconv.Itoa(p.MaxVideoBitrate)+"k",
+			"-bufsize", strconv.Itoa(2*p.MaxVideoBitrate)+"k",
+		)
+	}
+	return args
+}
+
+// passProgress maps the progress of one pass of a two-pass encode to its
+// half of the total, starting at offset percent
+func passProgress(onProgress ProgressFunc, offset float64) ProgressFunc {
+	if onProgress == nil {
+		return nil
+	}
+	return func(progress Progress) {
+		progress.Percent = offset + progress.Percent/2
+		onProgress(progress)
+	}
+}
+
+// transcode encodes the file at srcPath for the preset into a new file next
+// to it and removes the source. duration is the length in seconds, used for
+// the bitrate and progress.
+func (s *YtDlpService) transcode(ctx context.Context, p *Preset, srcPath string, duration float64, onProgress ProgressFunc) (string, error) {
+	bitrate, err := p.videoBitrate(duration)
+	if err != nil {
+		return "", err
+	}
+
+	dstPath := strings.TrimSuffix(srcPath, filepath.Ext(srcPath)) + " [" + p.Name + "].mp4"
+	passLog := strings.TrimSuffix(srcPath, filepath.Ext(srcPath)) + ".passlog"
+	defer func() {
+		matches, _ := filepath.Glob(passLog + "*")
+		for _, m := range matches {
+			os.Remove(m)
+		}
+	}()
+
+	video := append([]string{}, presetEncoders[p.VideoCodec]...)
+	video = append(video, "-pix_fmt", "yuv420p")
+	if p.Profile != "" {
+		video = append(video, "-profile:v", p.Profile)
+	}
+	if p.Level != "" {
+		video = append(video, "-level", p.Level)
+	}
+	if p.MaxHeight > 0 {
+		video = append(video, "-vf", fmt.Sprintf("scale=-2:'min(%d,ih)'", p.MaxHeight))
+	}
+
+	video = append(video, p.rateArgs(bitrate)...)
+	passArgs := func(pass int) []string {
+		if p.VideoCodec == "h265" {
+			return []string{"-x265-params", fmt.Sprintf("pass=%d:stats=%s", pass, passLog)}
+		}
+		return []string{"-pass", strconv.Itoa(pass), "-passlogfile", passLog}
+	}
+
+	if bitrate == 0 {
+		if err := s.runFFmpeg(ctx, srcPath, dstPath, video, p, duration, onProgress); err != nil {
+			return "", err
+		}
+	} else {
+		// First pass only analyzes the video; each pass is half the progress
+		pass1 := append(append([]string{}, video...), passArgs(1)...)
+		if err := s.runFFmpeg(ctx, srcPath, os.DevNull, pass1, nil, duration, passProgress(onProgress, 0)); err != nil {
+			return "", err
+		}
+		pass2 := append(append([]string{}, video...), passArgs(2)...)
+		if err := s.runFFmpeg(ctx, srcPath, dstPath, pass2, p, duration, passProgress(onProgress, 50)); err != nil {
+			os.Remove(dstPath)
+			return "", err
+		}
+	}
+
+	os.Remove(srcPath)
+	return dstPath, nil
+}
+
+// runFFmpeg encodes src to dst with the video args. A nil preset means an
+// analysis pass without audio or output file.
+func (s *YtDlpService) runFFmpeg(ctx context.Context, src, dst string, video []string, p *Preset, duration float64, onProgress ProgressFunc) error {
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", src, "-progress", "pipe:1", "-nostats"}
+	if p == nil {
+		args = append(args, "-map", "0:v:0", "-an", "-sn")
+		args = append(args, video...)
+		args = append(args, "-f", "mp4", dst)
+	} else {
+		// Subtitles embedded earlier are kept as mov_text
+		args = append(args, "-map", "0:v:0", "-map", "0:a:0?", "-map", "0:s?")
+		args = append(args, video...)
+		args = append(args,
+			"-c:a", "aac", "-b:a", strconv.Itoa(p.AudioBitrate)+"k",
+			"-c:s", "mov_text",
+			"-movflags", "+faststart",
+			dst,
+		)
+	}
+
+	cmd := exec.CommandContext(ctx, s.ffmpegPath, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	reportTranscodeProgress(stdout, duration, onProgress)
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// reportTranscodeProgress reads ffmpeg's -progress output until EOF
+func reportTranscodeProgress(r io.Reader, duration float64, onProgress ProgressFunc) {
+	scanner := bufio.NewScanner(r)
+	last := -1.0
+	for scanner.Scan() {
+		if onProgress == nil {
+			continue
+		}
+		// Each -progress block carries the same time in several units
+		progress, ok := ParseTranscodeLine(scanner.Text(), duration)
+		if !ok || progress.Percent == last {
+			continue
+		}
+		last = progress.Percent
+		onProgress(progress)
+	}
+	io.Copy(io.Discard, r)
+}
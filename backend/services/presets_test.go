@@ -0,0 +1,89 @@
+package services
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPresetVideoBitrate(t *testing.T) {
+	whatsapp := Preset{Name: "whatsapp", MaxSizeMB: 16, MaxVideoBitrate: 1500, AudioBitrate: 96}
+	tests := []struct {
+		name     string
+		preset   Preset
+		duration float64
+		want     int
+		wantErr  bool
+	}{
+		{"fits the size", whatsapp, 120, 938, false},
+		{"capped", whatsapp, 30, 1500, false},
+		{"uncapped", Preset{Name: "telegram", MaxSizeMB: 2000, AudioBitrate: 192}, 3600, 4119, false},
+		{"too long", whatsapp, 1200, 0, true},
+		{"duration unknown", whatsapp, 0, 0, true},
+		{"constant quality", Preset{CRF: 20}, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.preset.videoBitrate(tt.duration)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("videoBitrate = %d, %v, want %d, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPresetRateArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		preset  Preset
+		bitrate int
+		want    []string
+	}{
+		{"two-pass", Preset{MaxVideoBitrate: 8000}, 4200, []string{"-b:v", "4200k"}},
+		{"constant quality", Preset{CRF: 20}, 0, []string{"-crf", "20"}},
+		{"default quality", Preset{}, 0, []string{"-crf", "23"}},
+		{"constant quality capped", Preset{CRF: 23, MaxVideoBitrate: 1500}, 0, []string{"-crf", "23", "-maxrate", "1500k", "-bufsize", "3000k"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.preset.rateArgs(tt.bitrate); !slices.Equal(got, tt.want) {
+				t.Fatalf("rateArgs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPassProgress(t *testing.T) {
+	var got []float64
+	onProgress := func(p Progress) { got = append(got, p.Percent) }
+
+	pass1, pass2 := passProgress(onProgress, 0), passProgress(onProgress, 50)
+	for _, percent := range []float64{0, 50, 100} {
+		pass1(Progress{Phase: PhaseTranscode, Percent: percent})
+	}
+	for _, percent := range []float64{0, 50, 100} {
+		pass2(Progress{Phase: PhaseTranscode, Percent: percent})
+	}
+
+	if want := []float64{0, 25, 50, 50, 75, 100}; !slices.Equal(got, want) {
+		t.Fatalf("progress = %v, want %v", got, want)
+	}
+	if passProgress(nil, 50) != nil {
+		t.Fatal("passProgress(nil) should stay nil")
+	}
+}
+
+func TestReportTranscodeProgress(t *testing.T) {
+	output := strings.Join([]string{
+		"frame=0", "out_time_us=N/A", "out_time_ms=N/A", "out_time=N/A", "progress=continue",
+		"frame=240", "out_time_us=5000000", "out_time_ms=5000000", "out_time=00:00:05.000000", "progress=continue",
+		"frame=480", "out_time_us=10000000", "out_time_ms=10000000", "out_time=00:00:10.000000", "progress=end",
+	}, "\n")
+
+	var got []float64
+	reportTranscodeProgress(strings.NewReader(output), 10, func(p Progress) { got = append(got, p.Percent) })
+	// One update per block, though each carries the time three times
+	if want := []float64{50, 100}; !slices.Equal(got, want) {
+		t.Fatalf("progress = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type ProgressPhase string
+
+const (
+	PhaseVideo       ProgressPhase = "video"
+	PhaseAudio       ProgressPhase = "audio"
+	PhaseMerge       ProgressPhase = "merge"
+	PhasePostprocess ProgressPhase = "postprocess"
+	PhaseTranscode   ProgressPhase = "transcode"
+)
+
+// Progress is a single progress update reported by yt-dlp
+type Progress struct {
+	Phase      ProgressPhase `json:"phase"`
+	Downloaded int64         `json:"downloaded"`
+	Total      int64         `json:"total,omitempty"`
+	Speed      float64       `json:"speed,omitempty"` // bytes per second
+	ETA        int           `json:"eta,omitempty"`   // seconds
+	Percent    float64       `json:"percent"`
+}
+
+// ProgressFunc receives parsed progress updates
+type ProgressFunc func(Progress)
+
+// progressMarker prefixes our machine-readable progress lines so they can be
+// told apart from the rest of yt-dlp's output
+const progressMarker = "[viddown]"
+
+// progressArgs makes yt-dlp print one progress line per update in a format
+// understood by ProgressParser
+func progressArgs() []string {
+	return []string{
+		"--newline",
+		"--progress-template",
+		"download:" + progressMarker +
+			" %(info.vcodec)s" +
+			" %(progress.downloaded_bytes)s" +
+			" %(progress.total_bytes)s" +
+			" %(progress.total_bytes_estimate)s" +
+			" %(progress.speed)s" +
+			" %(progress.eta)s",
+	}
+}
+
+// ProgressParser is an io.Writer that turns yt-dlp output into progress
+// updates. It can be attached to stdout or stderr of any yt-dlp invocation
+// that was started with progressArgs.
+type ProgressParser struct {
+	onProgress ProgressFunc
+
+	mu      sync.Mutex
+	buf     []byte
+	discard bool // Skipping the rest of an overlong line
+}
+
+// maxProgressLine caps the bytes buffered for one line, so output without
+// line breaks can't grow the buffer without bound
+const maxProgressLine = 4096
+
+// NewProgressParser creates a parser calling fn for every update; fn may be nil
+func NewProgressParser(fn ProgressFunc) *ProgressParser {
+	return &ProgressParser{onProgress: fn}
+}
+
+func (p *ProgressParser) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf = append(p.buf, b...)
+	for {
+		idx := bytes.IndexAny(p.buf, "\r\n")
+		if idx == -1 {
+			break
+		}
+		line := string(p.buf[:idx])
+		p.buf = p.buf[idx+1:]
+		if p.discard {
+			p.discard = false
+			continue
+		}
+
+		if progress, ok := ParseProgressLine(line); ok && p.onProgress != nil {
+			p.onProgress(progress)
+		}
+	}
+	if len(p.buf) > maxProgressLine {
+		// No progress line is this long; drop it up to the next line break
+		p.buf = nil
+		p.discard = true
+	}
+	return len(b), nil
+}
+
+// ParseProgressLine parses a single line of yt-dlp output
+func ParseProgressLine(line string) (Progress, bool) {
+	line = strings.TrimSpace(line)
+
+	switch {
+	case strings.HasPrefix(line, "[Merger]"):
+		return Progress{Phase: PhaseMerge}, true
+	case strings.HasPrefix(line, "[ExtractAudio]"),
+		strings.HasPrefix(line, "[VideoConvertor]"),
+		strings.HasPrefix(line, "[VideoRemuxer]"):
+		return Progress{Phase: PhasePostprocess}, true
+	case !strings.HasPrefix(line, progressMarker):
+		return Progress{}, false
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(line, progressMarker))
+	if len(fields) != 6 {
+		return Progress{}, false
+	}
+
+	progress := Progress{
+		Phase:      PhaseVideo,
+		Downloaded: parseProgressInt(fields[1]),
+		Total:      parseProgressInt(fields[2]),
+		Speed:      parseProgressFloat(fields[4]),
+		ETA:        int(parseProgressInt(fields[5])),
+	}
+	if fields[0] == "none" {
+		progress.Phase = PhaseAudio
+	}
+	if progress.Total == 0 {
+		progress.Total = parseProgressInt(fields[3])
+	}
+	if progress.Total > 0 {
+		progress.Percent = float64(progress.Downloaded) / float64(progress.Total) * 100
+	}
+
+	return progress, true
+}
+
+// ParseTranscodeLine parses a line of ffmpeg -progress or -stats output into
+// a transcode update, given the duration of the output in seconds
+func ParseTranscodeLine(line string, duration float64) (Progress, bool) {
+	if duration <= 0 {
+		return Progress{}, false
+	}
+	for _, field := range strings.Fields(line) {
+		key, value, _ := strings.Cut(field, "=")
+		var seconds float64
+		var ok bool
+		switch key {
+		case "out_time_us", "out_time_ms":
+			// out_time_ms is in microseconds too
+			us, err := strconv.ParseInt(value, 10, 64)
+			seconds, ok = float64(us)/1e6, err == nil
+		case "out_time", "time":
+			seconds, ok = parseClock(value)
+		default:
+			continue
+		}
+		if !ok {
+			return Progress{}, false
+		}
+		return Progress{
+			Phase:   PhaseTranscode,
+			Percent: min(max(seconds, 0)/duration*100, 100),
+		}, true
+	}
+	return Progress{}, false
+}
+
+// parseClock parses ffmpeg timestamps like 00:01:02.500000, which are N/A
+// before the first frame
+func parseClock(s string) (float64, bool) {
+	h, rest, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, false
+	}
+	m, sec, ok := strings.Cut(rest, ":")
+	if !ok {
+		return 0, false
+	}
+	hours, err1 := strconv.Atoi(strings.TrimPrefix(h, "-"))
+	minutes, err2 := strconv.Atoi(m)
+	seconds, err3 := strconv.ParseFloat(sec, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, false
+	}
+	total := float64(hours*3600+minutes*60) + seconds
+	if strings.HasPrefix(h, "-") {
+		total = -total
+	}
+	return total, true
+}
+
+// parseProgressInt parses yt-dlp numeric fields, which are "NA" when unknown
+// and may be printed as floats
+func parseProgressInt(s string) int64 {
+	return int64(parseProgressFloat(s))
+}
+
+func parseProgressFloat(s string) float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return f
+}
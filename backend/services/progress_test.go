@@ -0,0 +1,134 @@
+package services
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseProgressLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want Progress
+		ok   bool
+	}{
+		{"video", "[viddown] avc1.64001F 5000 10000 NA 2500.5 2",
+			Progress{Phase: PhaseVideo, Downloaded: 5000, Total: 10000, Speed: 2500.5, ETA: 2, Percent: 50}, true},
+		{"audio", "[viddown] none 2500 10000 NA NA NA",
+			Progress{Phase: PhaseAudio, Downloaded: 2500, Total: 10000, Percent: 25}, true},
+		{"estimated total", "[viddown] vp9 1000 NA 4000.0 NA NA",
+			Progress{Phase: PhaseVideo, Downloaded: 1000, Total: 4000, Percent: 25}, true},
+		{"unknown total", "[viddown] vp9 1000 NA NA NA NA",
+			Progress{Phase: PhaseVideo, Downloaded: 1000}, true},
+		{"padded", "  [viddown] vp9 1000 2000 NA NA NA  ",
+			Progress{Phase: PhaseVideo, Downloaded: 1000, Total: 2000, Percent: 50}, true},
+		{"missing fields", "[viddown] vp9 1000 2000", Progress{}, false},
+		{"download destination", "[download] Destination: /tmp/video.f137.mp4", Progress{}, false},
+		{"download done", "[download] 100% of   10.00MiB in 00:00:02 at 4.50MiB/s", Progress{}, false},
+		{"merge", `[Merger] Merging formats into "/tmp/video.mp4"`, Progress{Phase: PhaseMerge}, true},
+		{"extract audio", "[ExtractAudio] Destination: /tmp/audio.mp3", Progress{Phase: PhasePostprocess}, true},
+		{"convert", "[VideoConvertor] Converting video from webm to mp4", Progress{Phase: PhasePostprocess}, true},
+		{"remux", "[VideoRemuxer] Remuxing video from webm to mkv", Progress{Phase: PhasePostprocess}, true},
+		{"other", "[youtube] dQw4w9WgXcQ: Downloading webpage", Progress{}, false},
+		{"empty", "", Progress{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseProgressLine(tt.line)
+			if ok != tt.ok || got != tt.want {
+				t.Fatalf("ParseProgressLine(%q) = %+v, %v, want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestProgressParser(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   []ProgressPhase
+	}{
+		{"newlines", []string{"[viddown] vp9 1 2 NA NA NA\n[viddown] none 1 2 NA NA NA\n"},
+			[]ProgressPhase{PhaseVideo, PhaseAudio}},
+		{"carriage returns", []string{"[viddown] vp9 1 2 NA NA NA\r[viddown] vp9 2 2 NA NA NA\r"},
+			[]ProgressPhase{PhaseVideo, PhaseVideo}},
+		{"crlf", []string{"[viddown] vp9 1 2 NA NA NA\r\n[Merger] Merging\r\n"},
+			[]ProgressPhase{PhaseVideo, PhaseMerge}},
+		{"split across writes", []string{"[vidd", "own] none 1 2 NA", " NA NA\n[Extract", "Audio] Destination: a.mp3\n"},
+			[]ProgressPhase{PhaseAudio, PhasePostprocess}},
+		{"unterminated", []string{"[viddown] vp9 1 2 NA NA NA"}, nil},
+		{"phase changes", []string{
+			"[viddown] vp9 2 2 NA NA NA\n",
+			"[viddown] none 2 2 NA NA NA\n",
+			"[Merger] Merging formats into \"v.mp4\"\n",
+			"[VideoConvertor] Converting video\n",
+		}, []ProgressPhase{PhaseVideo, PhaseAudio, PhaseMerge, PhasePostprocess}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []ProgressPhase
+			p := NewProgressParser(func(progress Progress) { got = append(got, progress.Phase) })
+			for _, w := range tt.writes {
+				if n, err := p.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write = %d, %v", n, err)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("phases = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProgressParserCapsLongLines(t *testing.T) {
+	var got []Progress
+	p := NewProgressParser(func(progress Progress) { got = append(got, progress) })
+
+	// Output without line breaks is dropped instead of buffered
+	junk := []byte(strings.Repeat("x", 1000))
+	for range 100 {
+		p.Write(junk)
+		if len(p.buf) > maxProgressLine {
+			t.Fatalf("buffered %d bytes, want at most %d", len(p.buf), maxProgressLine)
+		}
+	}
+	// The rest of the overlong line is skipped, even if it looks like progress
+	p.Write([]byte("[viddown] vp9 1 2 NA NA NA\n[viddown] vp9 2 2 NA NA NA\n"))
+	if len(got) != 1 || got[0].Downloaded != 2 {
+		t.Fatalf("updates = %+v, want only the one after the line break", got)
+	}
+}
+
+func TestParseTranscodeLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		percent float64
+		ok      bool
+	}{
+		{"out_time_us", "out_time_us=30000000", 25, true},
+		{"out_time_ms", "out_time_ms=60000000", 50, true},
+		{"out_time", "out_time=00:01:30.000000", 75, true},
+		{"out_time unknown", "out_time_us=N/A", 0, false},
+		{"negative start", "out_time=-00:00:00.023220", 0, true},
+		{"past the end", "out_time_us=150000000", 100, true},
+		{"stats", "frame=  720 fps= 60 q=28.0 size=    2048kB time=00:01:00.00 bitrate= 279.6kbits/s speed=2.0x", 50, true},
+		{"audio stats", "size=     512kB time=00:00:12.00 bitrate= 349.5kbits/s speed=8.1x", 10, true},
+		{"stats before the first frame", "frame=    0 fps=0.0 q=0.0 size=       0kB time=N/A bitrate=N/A", 0, false},
+		{"other key", "total_size=2097152", 0, false},
+		{"progress marker", "progress=continue", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseTranscodeLine(tt.line, 120)
+			if ok != tt.ok || got.Percent != tt.percent || (ok && got.Phase != PhaseTranscode) {
+				t.Fatalf("ParseTranscodeLine(%q) = %+v, %v, want %v%%, %v", tt.line, got, ok, tt.percent, tt.ok)
+			}
+		})
+	}
+
+	if _, ok := ParseTranscodeLine("out_time_us=30000000", 0); ok {
+		t.Fatal("parsed progress without a duration")
+	}
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueFull    = errors.New("download queue is full")
+	ErrQueueTimeout = errors.New("timed out waiting in download queue")
+)
+
+// PositionFunc receives the 1-based position of a client in the queue
+// whenever it changes
+type PositionFunc func(position int)
+
+type waiter struct {
+	client     string
+	ready      chan struct{}
+	elem       *list.Element
+	onPosition PositionFunc
+	position   int
+}
+
+// AdmissionQueue limits concurrent downloads. Requests that don't get a slot
+// right away wait in FIFO order; a client already holding maxPerClient slots
+// is skipped so that one IP cannot take every slot.
+type AdmissionQueue struct {
+	slots        int
+	maxPerClient int
+	maxDepth     int
+	maxWait      time.Duration
+
+	mu       sync.Mutex
+	active   int
+	byClient map[string]int
+	waiters  *list.List
+}
+
+// NewAdmissionQueue creates a queue with the given number of slots.
+// maxPerClient, maxDepth and maxWait are disabled when zero.
+func NewAdmissionQueue(slots, maxPerClient, maxDepth int, maxWait time.Duration) *AdmissionQueue {
+	return &AdmissionQueue{
+		slots:        slots,
+		maxPerClient: maxPerClient,
+		maxDepth:     maxDepth,
+		maxWait:      maxWait,
+		byClient:     make(map[string]int),
+		waiters:      list.New(),
+	}
+}
+
+// Acquire waits for a download slot. It returns ErrQueueFull when the queue
+// is at max depth, ErrQueueTimeout after waiting longer than max wait, or the
+// context error when ctx is done. On success the returned func must be called
+// to free the slot.
+func (q *AdmissionQueue) Acquire(ctx context.Context, client string, onPosition PositionFunc) (release func(), err error) {
+	q.mu.Lock()
+	if q.maxDepth > 0 && q.waiters.Len() >= q.maxDepth {
+		q.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+
+	w := &waiter{
+		client:     client,
+		ready:      make(chan struct{}),
+		onPosition: onPosition,
+	}
+	w.elem = q.waiters.PushBack(w)
+	notify := q.dispatchLocked()
+	q.mu.Unlock()
+	notify()
+
+	var timeout <-chan time.Time
+	if q.maxWait > 0 {
+		timer := time.NewTimer(q.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-w.ready:
+		return q.releaseFunc(client), nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = ErrQueueTimeout
+	}
+
+	q.mu.Lock()
+	select {
+	case <-w.ready:
+		// Admitted while we were giving up; hand the slot back
+		q.mu.Unlock()
+		q.releaseFunc(client)()
+		return nil, err
+	default:
+	}
+	q.waiters.Remove(w.elem)
+	notify = q.dispatchLocked()
+	q.mu.Unlock()
+	notify()
+
+	return nil, err
+}
+
+// Waiting returns the number of queued requests
+func (q *AdmissionQueue) Waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiters.Len()
+}
+
+func (q *AdmissionQueue) releaseFunc(client string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			q.active--
+			q.byClient[client]--
+			if q.byClient[client] <= 0 {
+				delete(q.byClient, client)
+			}
+			notify := q.dispatchLocked()
+			q.mu.Unlock()
+			notify()
+		})
+	}
+}
+
+// dispatchLocked admits waiters while slots are free and recomputes queue
+// positions. Position callbacks are returned instead of called so they run
+// without holding the lock.
+func (q *AdmissionQueue) dispatchLocked() (notify func()) {
+	for e := q.waiters.Front(); e != nil && q.active < q.slots; {
+		w := e.Value.(*waiter)
+		next := e.Next()
+		if q.maxPerClient <= 0 || q.byClient[w.client] < q.maxPerClient {
+			q.waiters.Remove(e)
+			q.active++
+			q.byClient[w.client]++
+			close(w.ready)
+		}
+		e = next
+	}
+
+	var callbacks []func()
+	position := 0
+	for e := q.waiters.Front(); e != nil; e = e.Next() {
+		w := e.Value.(*waiter)
+		position++
+		if w.position != position && w.onPosition != nil {
+			pos, fn := position, w.onPosition
+			callbacks = append(callbacks, func() { fn(pos) })
+		}
+		w.position = position
+	}
+
+	return func() {
+		for _, fn := range callbacks {
+			fn()
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// acquireAsync starts Acquire in the background and returns a channel
+// delivering its release func, or nil on error
+func acquireAsync(q *AdmissionQueue, ctx context.Context, client string) <-chan func() {
+	ch := make(chan func(), 1)
+	go func() {
+		release, err := q.Acquire(ctx, client, nil)
+		if err != nil {
+			ch <- nil
+			return
+		}
+		ch <- release
+	}()
+	return ch
+}
+
+// waitQueued waits until n requests are waiting
+func waitQueued(t *testing.T, q *AdmissionQueue, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Waiting() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("waiting = %d, want %d", q.Waiting(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func admitted(t *testing.T, ch <-chan func()) func() {
+	t.Helper()
+	select {
+	case release := <-ch:
+		if release == nil {
+			t.Fatal("Acquire failed")
+		}
+		return release
+	case <-time.After(2 * time.Second):
+		t.Fatal("not admitted")
+		return nil
+	}
+}
+
+func notAdmitted(t *testing.T, ch <-chan func()) {
+	t.Helper()
+	select {
+	case <-ch:
+		t.Fatal("admitted too early")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestAdmissionQueueFIFO(t *testing.T) {
+	q := NewAdmissionQueue(1, 0, 0, 0)
+	ctx := context.Background()
+	release := admitted(t, acquireAsync(q, ctx, "a"))
+
+	var positions []int
+	first := make(chan func(), 1)
+	go func() {
+		r, _ := q.Acquire(ctx, "b", func(position int) { positions = append(positions, position) })
+		first <- r
+	}()
+	waitQueued(t, q, 1)
+	second := acquireAsync(q, ctx, "c")
+	waitQueued(t, q, 2)
+
+	release()
+	releaseFirst := admitted(t, first)
+	notAdmitted(t, second)
+	releaseFirst()
+	admitted(t, second)()
+
+	if len(positions) != 1 || positions[0] != 1 {
+		t.Fatalf("positions of the first waiter = %v, want [1]", positions)
+	}
+}
+
+func TestAdmissionQueueSkipsBusyClient(t *testing.T) {
+	q := NewAdmissionQueue(2, 1, 0, 0)
+	ctx := context.Background()
+	releaseA := admitted(t, acquireAsync(q, ctx, "a"))
+
+	// "a" is at its limit, so "b" queued behind it takes the free slot
+	secondA := acquireAsync(q, ctx, "a")
+	waitQueued(t, q, 1)
+	releaseB := admitted(t, acquireAsync(q, ctx, "b"))
+	notAdmitted(t, secondA)
+
+	releaseA()
+	admitted(t, secondA)()
+	releaseB()
+}
+
+func TestAdmissionQueueDepthLimit(t *testing.T) {
+	q := NewAdmissionQueue(1, 0, 1, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	release := admitted(t, acquireAsync(q, ctx, "a"))
+	defer release()
+
+	acquireAsync(q, ctx, "b")
+	waitQueued(t, q, 1)
+	if _, err := q.Acquire(ctx, "c", nil); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Acquire error = %v, want ErrQueueFull", err)
+	}
+}
+
+func TestAdmissionQueueTimeout(t *testing.T) {
+	q := NewAdmissionQueue(1, 0, 0, 20*time.Millisecond)
+	release := admitted(t, acquireAsync(q, context.Background(), "a"))
+
+	if _, err := q.Acquire(context.Background(), "b", nil); !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("Acquire error = %v, want ErrQueueTimeout", err)
+	}
+	if q.Waiting() != 0 {
+		t.Fatalf("waiting = %d after timeout, want 0", q.Waiting())
+	}
+
+	// The slot held by "a" is still accounted for, and freed on release
+	release()
+	admitted(t, acquireAsync(q, context.Background(), "b"))()
+}
+
+func TestAdmissionQueueCancel(t *testing.T) {
+	q := NewAdmissionQueue(1, 0, 0, 0)
+	release := admitted(t, acquireAsync(q, context.Background(), "a"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		_, err := q.Acquire(ctx, "b", nil)
+		canceled <- err
+	}()
+	waitQueued(t, q, 1)
+	behind := acquireAsync(q, context.Background(), "c")
+	waitQueued(t, q, 2)
+
+	cancel()
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Acquire error = %v, want context.Canceled", err)
+	}
+	waitQueued(t, q, 1)
+
+	// The canceled waiter doesn't hold up the one behind it
+	release()
+	admitted(t, behind)()
+}
@@ -0,0 +1,67 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Conversions to MP4 applied on download
+const (
+	ConvertRemux     = "remux"     // Codecs fit MP4, only the container changes
+	ConvertTranscode = "transcode" // Codecs have to be re-encoded
+)
+
+// mp4Codecs are codec prefixes, as reported by yt-dlp, that MP4 can hold
+var mp4Codecs = []string{
+	"avc1", "avc3", "h264", "hev1", "hvc1", "h265", "av01", "vp09", "vp9",
+	"mp4a", "aac", "opus", "ac-3", "ec-3", "flac", "mp3",
+}
+
+func fitsMP4(codec string) bool {
+	if codec == "" {
+		return true
+	}
+	for _, prefix := range mp4Codecs {
+		if strings.HasPrefix(codec, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// conversionFor returns the conversion a video stream needs to end up in
+// MP4, or "" when it is MP4 already
+func conversionFor(ext, vcodec, acodec string) string {
+	switch {
+	case ext == "mp4":
+		return ""
+	case fitsMP4(vcodec) && fitsMP4(acodec):
+		return ConvertRemux
+	}
+	return ConvertTranscode
+}
+
+func (o DownloadOptions) validateConvert() error {
+	switch o.Convert {
+	case "", ConvertRemux, ConvertTranscode:
+	default:
+		return fmt.Errorf("%w: unsupported conversion %q", ErrInvalidOptions, o.Convert)
+	}
+	if o.Convert != "" && (o.AudioFormat != "" || o.SubtitlesOnly() || o.Preset != "") {
+		return fmt.Errorf("%w: convert only applies to video as is", ErrInvalidOptions)
+	}
+	return nil
+}
+
+// convertArgs returns the yt-dlp arguments converting the output to MP4
+func (o DownloadOptions) convertArgs() []string {
+	switch o.Convert {
+	case ConvertRemux:
+		return []string{"--remux-video", "mp4"}
+	case ConvertTranscode:
+		// Merging into MP4 would fail for these codecs, so merge into MKV
+		// and re-encode from there
+		return []string{"--merge-output-format", "mkv", "--recode-video", "mp4"}
+	}
+	return nil
+}
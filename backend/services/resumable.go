@@ -0,0 +1,251 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var ErrRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// RangeError is ErrRangeNotSatisfiable along with the size of the stream,
+// which a 416 response has to name in Content-Range
+type RangeError struct {
+	Total int64 // -1 when unknown
+}
+
+func (e *RangeError) Error() string {
+	if e.Total < 0 {
+		return ErrRangeNotSatisfiable.Error()
+	}
+	return fmt.Sprintf("%s: stream is %d bytes", ErrRangeNotSatisfiable, e.Total)
+}
+
+func (e *RangeError) Unwrap() error {
+	return ErrRangeNotSatisfiable
+}
+
+// reconnectBackoff is the wait before the first reconnect, growing linearly
+// with every further attempt
+var reconnectBackoff = 500 * time.Millisecond
+
+// RefreshFunc returns a fresh stream URL when the signed one has expired
+type RefreshFunc func(ctx context.Context) (*StreamInfo, error)
+
+var singleRangePattern = regexp.MustCompile(`^bytes=(\d+)-(\d*)$`)
+
+// ResumableReader reads a CDN stream and, when the connection drops, re-issues
+// the request with Range: bytes=N- from the first byte not yet delivered, so
+// the reader sees one continuous stream. When the CDN rejects the signed URL
+// (403/410) the URL is refreshed first. Reconnects are bounded by maxRetries.
+type ResumableReader struct {
+	ctx        context.Context
+	client     *http.Client
+	info       *StreamInfo
+	refresh    RefreshFunc
+	maxRetries int
+
+	rangeHeader string // Client Range header, sent as-is on the first request
+	resumable   bool   // Whether the range is simple enough to resume
+	start       int64  // First byte requested
+	end         int64  // Last byte requested, -1 for open-ended
+	delivered   int64
+
+	retries  int
+	body     io.ReadCloser
+	response *http.Response
+}
+
+// OpenResumable starts streaming info.URL. rangeHeader is the client's Range
+// header; streams can only be resumed for a single "bytes=N-" or "bytes=N-M"
+// range, other ranges are passed through without reconnects.
+func OpenResumable(ctx context.Context, client *http.Client, info *StreamInfo, rangeHeader string, refresh RefreshFunc, maxRetries int) (*ResumableReader, error) {
+	r := &ResumableReader{
+		ctx:         ctx,
+		client:      client,
+		info:        info,
+		refresh:     refresh,
+		maxRetries:  maxRetries,
+		rangeHeader: rangeHeader,
+		resumable:   rangeHeader == "",
+		end:         -1,
+	}
+	if m := singleRangePattern.FindStringSubmatch(rangeHeader); m != nil {
+		r.resumable = true
+		r.start, _ = strconv.ParseInt(m[1], 10, 64)
+		if m[2] != "" {
+			r.end, _ = strconv.ParseInt(m[2], 10, 64)
+		}
+	}
+
+	resp, err := r.do(rangeHeader)
+	if err != nil {
+		return nil, err
+	}
+	if isExpired(resp) && refresh != nil {
+		resp.Body.Close()
+		if err := r.refreshURL(); err != nil {
+			return nil, err
+		}
+		if resp, err = r.do(rangeHeader); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return nil, &RangeError{Total: unsatisfiedRangeTotal(resp, info)}
+		}
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	// A range the CDN ignored must not be resumed from our offsets
+	if resp.StatusCode == http.StatusOK && r.start > 0 {
+		r.resumable = false
+		r.start = 0
+	}
+
+	r.body = resp.Body
+	r.response = resp
+	return r, nil
+}
+
+// Response returns the response of the first request, whose status and
+// headers describe the whole stream
+func (r *ResumableReader) Response() *http.Response {
+	return r.response
+}
+
+func (r *ResumableReader) Read(p []byte) (int, error) {
+	for {
+		if r.body == nil {
+			if err := r.reconnect(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.body.Read(p)
+		r.delivered += int64(n)
+		if err == nil || err == io.EOF || !r.resumable || r.ctx.Err() != nil || r.retries >= r.maxRetries {
+			return n, err
+		}
+
+		// Connection dropped mid-stream; reconnect on this or the next Read
+		r.body.Close()
+		r.body = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *ResumableReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
+
+// Retries returns the number of reconnects made so far
+func (r *ResumableReader) Retries() int {
+	return r.retries
+}
+
+func (r *ResumableReader) reconnect() error {
+	offset := r.start + r.delivered
+	rangeHeader := fmt.Sprintf("bytes=%d-", offset)
+	if r.end >= 0 {
+		rangeHeader = fmt.Sprintf("bytes=%d-%d", offset, r.end)
+	}
+
+	for r.retries < r.maxRetries {
+		r.retries++
+
+		// Back off a little more on every attempt
+		select {
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		case <-time.After(time.Duration(r.retries) * reconnectBackoff):
+		}
+
+		resp, err := r.do(rangeHeader)
+		if err != nil {
+			continue
+		}
+		if isExpired(resp) && r.refresh != nil {
+			resp.Body.Close()
+			if err := r.refreshURL(); err != nil {
+				return err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusPartialContent || !rangeStartsAt(resp, offset) {
+			resp.Body.Close()
+			continue
+		}
+
+		r.body = resp.Body
+		return nil
+	}
+
+	return fmt.Errorf("stream interrupted after %d reconnects", r.retries)
+}
+
+func (r *ResumableReader) do(rangeHeader string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.ctx, "GET", r.info.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set user agent, then the headers yt-dlp says the CDN expects
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
+	for key, value := range r.info.Headers {
+		req.Header.Set(key, value)
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+
+	return r.client.Do(req)
+}
+
+func (r *ResumableReader) refreshURL() error {
+	info, err := r.refresh(r.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to refresh stream URL: %w", err)
+	}
+	r.info = info
+	return nil
+}
+
+// isExpired reports whether the CDN rejected the signed URL
+func isExpired(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusGone
+}
+
+// unsatisfiedRangeTotal returns the stream size from a 416 response's
+// "bytes */N", falling back to the size yt-dlp reported
+func unsatisfiedRangeTotal(resp *http.Response, info *StreamInfo) int64 {
+	var total int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &total); err == nil {
+		return total
+	}
+	if info.Size > 0 {
+		return info.Size
+	}
+	return -1
+}
+
+func rangeStartsAt(resp *http.Response, offset int64) bool {
+	var start, end, total int64
+	_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+	if err != nil {
+		// Unknown total is printed as "*"
+		_, err = fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/*", &start, &end)
+	}
+	return err == nil && start == offset
+}
@@ -0,0 +1,295 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func fastReconnects(t *testing.T) {
+	t.Helper()
+	backoff := reconnectBackoff
+	reconnectBackoff = time.Millisecond
+	t.Cleanup(func() { reconnectBackoff = backoff })
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+var testRangePattern = regexp.MustCompile(`^bytes=(\d+)-(\d*)$`)
+
+// cdnServer serves data with range support. respond may replace the answer
+// to the n-th request (0-based) by returning true.
+type cdnServer struct {
+	*httptest.Server
+	data []byte
+
+	mu      sync.Mutex
+	ranges  []string
+	paths   []string
+	respond func(n int, w http.ResponseWriter, r *http.Request) bool
+}
+
+func newCDNServer(t *testing.T, data []byte, respond func(n int, w http.ResponseWriter, r *http.Request) bool) *cdnServer {
+	t.Helper()
+	s := &cdnServer{data: data, respond: respond}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *cdnServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	n := len(s.ranges)
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	s.paths = append(s.paths, r.URL.Path)
+	s.mu.Unlock()
+
+	if s.respond != nil && s.respond(n, w, r) {
+		return
+	}
+	s.serveRange(w, r, -1)
+}
+
+// serveRange answers r from data, dropping the connection after dropAfter
+// bytes of the body unless it is negative
+func (s *cdnServer) serveRange(w http.ResponseWriter, r *http.Request, dropAfter int) {
+	total := int64(len(s.data))
+	start, end := int64(0), total-1
+	status := http.StatusOK
+	if m := testRangePattern.FindStringSubmatch(r.Header.Get("Range")); m != nil {
+		start, _ = strconv.ParseInt(m[1], 10, 64)
+		if m[2] != "" {
+			end, _ = strconv.ParseInt(m[2], 10, 64)
+		}
+		if start >= total {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		end = min(end, total-1)
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(status)
+
+	body := s.data[start : end+1]
+	if dropAfter >= 0 && dropAfter < len(body) {
+		w.Write(body[:dropAfter])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.Write(body)
+}
+
+func (s *cdnServer) requests() (ranges, paths []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ranges...), append([]string(nil), s.paths...)
+}
+
+// dropFirst drops the first response after n bytes
+func dropFirst(s **cdnServer, n int) func(int, http.ResponseWriter, *http.Request) bool {
+	return func(i int, w http.ResponseWriter, r *http.Request) bool {
+		if i != 0 {
+			return false
+		}
+		(*s).serveRange(w, r, n)
+		return true
+	}
+}
+
+func TestResumableReaderResumes(t *testing.T) {
+	fastReconnects(t)
+	data := randomBytes(t, 100_000)
+
+	tests := []struct {
+		name        string
+		rangeHeader string
+		start       int
+		want        []byte
+		resumeEnd   string // Expected end of the resume range
+	}{
+		{"whole stream", "", 0, data, ""},
+		{"open range", "bytes=1000-", 1000, data[1000:], ""},
+		{"closed range", "bytes=1000-59999", 1000, data[1000:60000], "59999"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var server *cdnServer
+			server = newCDNServer(t, data, dropFirst(&server, 30_000))
+
+			r, err := OpenResumable(context.Background(), server.Client(), &StreamInfo{URL: server.URL}, tt.rangeHeader, nil, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("got %d bytes, want %d matching bytes", len(got), len(tt.want))
+			}
+			if r.Retries() != 1 {
+				t.Fatalf("retries = %d, want 1", r.Retries())
+			}
+
+			ranges, _ := server.requests()
+			if len(ranges) != 2 || ranges[0] != tt.rangeHeader {
+				t.Fatalf("ranges = %q", ranges)
+			}
+			m := testRangePattern.FindStringSubmatch(ranges[1])
+			if m == nil || m[2] != tt.resumeEnd {
+				t.Fatalf("resume range = %q, want bytes=N-%s", ranges[1], tt.resumeEnd)
+			}
+			// The resume starts right after the delivered bytes
+			offset, _ := strconv.Atoi(m[1])
+			if offset <= tt.start || offset > tt.start+30_000 {
+				t.Fatalf("resumed at %d, want within the first response", offset)
+			}
+		})
+	}
+}
+
+func TestResumableReaderRejectsFullResponseToResume(t *testing.T) {
+	fastReconnects(t)
+	data := randomBytes(t, 100_000)
+	var server *cdnServer
+	server = newCDNServer(t, data, func(i int, w http.ResponseWriter, r *http.Request) bool {
+		if i == 0 {
+			server.serveRange(w, r, 30_000)
+			return true
+		}
+		// A CDN ignoring the range would send the stream again from 0
+		r.Header.Del("Range")
+		server.serveRange(w, r, -1)
+		return true
+	})
+
+	r, err := OpenResumable(context.Background(), server.Client(), &StreamInfo{URL: server.URL}, "", nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err == nil {
+		t.Fatal("expected an error after the retries ran out")
+	}
+	if !bytes.Equal(got, data[:len(got)]) {
+		t.Fatal("bytes of the full response were appended to the stream")
+	}
+	if r.Retries() != 2 {
+		t.Fatalf("retries = %d, want 2", r.Retries())
+	}
+}
+
+func TestResumableReaderRetryLimit(t *testing.T) {
+	fastReconnects(t)
+	data := randomBytes(t, 100_000)
+	var server *cdnServer
+	server = newCDNServer(t, data, func(i int, w http.ResponseWriter, r *http.Request) bool {
+		server.serveRange(w, r, 10_000)
+		return true
+	})
+
+	r, err := OpenResumable(context.Background(), server.Client(), &StreamInfo{URL: server.URL}, "", nil, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err == nil {
+		t.Fatal("expected an error after the retries ran out")
+	}
+	if !bytes.Equal(got, data[:len(got)]) {
+		t.Fatal("delivered bytes don't match the stream")
+	}
+	if ranges, _ := server.requests(); len(ranges) != 4 {
+		t.Fatalf("made %d requests, want the first and 3 retries", len(ranges))
+	}
+}
+
+func TestResumableReaderRefreshesExpiredURL(t *testing.T) {
+	fastReconnects(t)
+	data := randomBytes(t, 100_000)
+	var server *cdnServer
+	server = newCDNServer(t, data, func(i int, w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case r.URL.Path == "/old" && i == 0:
+			server.serveRange(w, r, 30_000)
+		case r.URL.Path == "/old":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			return false
+		}
+		return true
+	})
+	refresh := func(ctx context.Context) (*StreamInfo, error) {
+		return &StreamInfo{URL: server.URL + "/new"}, nil
+	}
+
+	r, err := OpenResumable(context.Background(), server.Client(), &StreamInfo{URL: server.URL + "/old"}, "", refresh, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("stream doesn't match after the refresh")
+	}
+	if _, paths := server.requests(); paths[len(paths)-1] != "/new" {
+		t.Fatalf("paths = %q, want the refreshed URL last", paths)
+	}
+}
+
+func TestOpenResumableRangeNotSatisfiable(t *testing.T) {
+	data := randomBytes(t, 1000)
+	server := newCDNServer(t, data, nil)
+	bare := newCDNServer(t, data, func(i int, w http.ResponseWriter, r *http.Request) bool {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return true
+	})
+
+	tests := []struct {
+		name string
+		info *StreamInfo
+		want int64
+	}{
+		{"total from the CDN", &StreamInfo{URL: server.URL}, 1000},
+		{"total from yt-dlp", &StreamInfo{URL: bare.URL, Size: 1000}, 1000},
+		{"total unknown", &StreamInfo{URL: bare.URL}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := OpenResumable(context.Background(), http.DefaultClient, tt.info, "bytes=5000-", nil, 3)
+			var rangeErr *RangeError
+			if !errors.Is(err, ErrRangeNotSatisfiable) || !errors.As(err, &rangeErr) {
+				t.Fatalf("error = %v, want a RangeError", err)
+			}
+			if rangeErr.Total != tt.want {
+				t.Fatalf("total = %d, want %d", rangeErr.Total, tt.want)
+			}
+		})
+	}
+}
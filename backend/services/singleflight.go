@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup collapses concurrent calls with the same key into one
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[T]
+}
+
+type flightCall[T any] struct {
+	done    chan struct{}
+	val     T
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Do runs fn once per key at a time; callers arriving while it runs wait for
+// and share its result. fn gets a context that is not canceled when the
+// caller that started it goes away, so the other waiters still get a result;
+// it is canceled once every caller has stopped waiting. Each caller stops
+// waiting when its own ctx is done.
+func (g *flightGroup[T]) Do(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (T, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall[T])
+	}
+	c, ok := g.calls[key]
+	if !ok {
+		runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &flightCall[T]{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+
+		go func() {
+			c.val, c.err = fn(runCtx)
+			cancel()
+
+			g.mu.Lock()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// Nobody wants the result anymore; later callers start afresh
+			c.cancel()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		var zero T
+		return zero, ctx.Err()
+	}
+}
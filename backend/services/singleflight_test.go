@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupCancelsWhenLastWaiterLeaves(t *testing.T) {
+	var g flightGroup[int]
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	fn := func(ctx context.Context) (int, error) {
+		close(started)
+		<-ctx.Done()
+		close(stopped)
+		return 0, ctx.Err()
+	}
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() { _, err := g.Do(first, "k", fn); errs <- err }()
+	<-started
+	go func() { _, err := g.Do(second, "k", fn); errs <- err }()
+
+	// Let the second caller join before the first leaves
+	time.Sleep(20 * time.Millisecond)
+	cancelFirst()
+	<-errs
+	select {
+	case <-stopped:
+		t.Fatal("run canceled while a waiter remained")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancelSecond()
+	<-errs
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("run not canceled after the last waiter left")
+	}
+}
+
+func TestFlightGroupSharesResult(t *testing.T) {
+	var g flightGroup[int]
+	release := make(chan struct{})
+	calls := 0
+	fn := func(ctx context.Context) (int, error) {
+		calls++
+		<-release
+		return 42, nil
+	}
+
+	results := make(chan int, 2)
+	for range 2 {
+		go func() { v, _ := g.Do(context.Background(), "k", fn); results <- v }()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	for range 2 {
+		if v := <-results; v != 42 {
+			t.Fatalf("got %d, want 42", v)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("fn ran %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Subtitle delivery modes
+const (
+	SubtitlesEmbed = "embed" // Embed tracks into the video
+	SubtitlesSRT   = "srt"   // Standalone files, converted server-side
+	SubtitlesVTT   = "vtt"
+	SubtitlesASS   = "ass"
+)
+
+var subtitleLangsPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(,[A-Za-z0-9_-]+)*$`)
+
+// SubtitleTrack is a subtitle language available for a video
+type SubtitleTrack struct {
+	Language string `json:"language"`
+	Name     string `json:"name,omitempty"`
+	Auto     bool   `json:"auto,omitempty"` // Automatic captions
+}
+
+type ytdlpSubtitle struct {
+	Ext  string `json:"ext"`
+	Name string `json:"name"`
+}
+
+// parseSubtitles lists manual subtitles first, then automatic captions for
+// languages without manual ones, each sorted by language
+func parseSubtitles(manual, auto map[string][]ytdlpSubtitle) []SubtitleTrack {
+	var tracks []SubtitleTrack
+	add := func(subs map[string][]ytdlpSubtitle, isAuto bool) {
+		langs := make([]string, 0, len(subs))
+		for lang, formats := range subs {
+			// live_chat is a "subtitle" on YouTube streams
+			if lang == "live_chat" || len(formats) == 0 {
+				continue
+			}
+			if _, ok := manual[lang]; isAuto && ok {
+				continue
+			}
+			langs = append(langs, lang)
+		}
+		sort.Strings(langs)
+
+		for _, lang := range langs {
+			tracks = append(tracks, SubtitleTrack{
+				Language: lang,
+				Name:     subs[lang][0].Name,
+				Auto:     isAuto,
+			})
+		}
+	}
+	add(manual, false)
+	add(auto, true)
+	return tracks
+}
+
+// SubtitlesOnly reports whether only subtitle files are downloaded
+func (o DownloadOptions) SubtitlesOnly() bool {
+	return o.Subtitles != "" && o.SubtitleMode != SubtitlesEmbed
+}
+
+func (o DownloadOptions) validateSubtitles() error {
+	switch o.SubtitleMode {
+	case "":
+		if o.Subtitles != "" {
+			return fmt.Errorf("%w: subtitles require a subtitle mode", ErrInvalidOptions)
+		}
+		return nil
+	case SubtitlesEmbed, SubtitlesSRT, SubtitlesVTT, SubtitlesASS:
+	default:
+		return fmt.Errorf("%w: unsupported subtitle mode %q", ErrInvalidOptions, o.SubtitleMode)
+	}
+
+	if !subtitleLangsPattern.MatchString(o.Subtitles) {
+		return fmt.Errorf("%w: subtitles must be a comma-separated list of languages", ErrInvalidOptions)
+	}
+	if o.SubtitleMode == SubtitlesEmbed && o.AudioFormat != "" {
+		return fmt.Errorf("%w: subtitles can't be embedded into audio", ErrInvalidOptions)
+	}
+	if o.SubtitlesOnly() && (o.AudioFormat != "" || o.Clip() || o.Chapter > 0 || o.SplitChapters) {
+		return fmt.Errorf("%w: standalone subtitles can't be combined with other options", ErrInvalidOptions)
+	}
+	return nil
+}
+
+func (o DownloadOptions) subtitleArgs() []string {
+	if o.Subtitles == "" {
+		return nil
+	}
+
+	// Manual subtitles are preferred over automatic captions
+	args := []string{"--write-subs", "--write-auto-subs", "--sub-langs", o.Subtitles}
+	if o.SubtitleMode == SubtitlesEmbed {
+		return append(args, "--embed-subs")
+	}
+	return append(args, "--skip-download", "--convert-subs", o.SubtitleMode)
+}
+
+// collectSubtitles finds the subtitle files written by a run with prefix.
+// A single file is returned as is, several are packed into a zip.
+func collectSubtitles(prefix string) (path, filename string, cleanup func(), err error) {
+	files, _ := filepath.Glob(filepath.Join(tempDir, prefix+"*"))
+	if len(files) == 0 {
+		return "", "", nil, fmt.Errorf("%w: no subtitles in the requested languages", ErrInvalidOptions)
+	}
+	if len(files) == 1 {
+		path = files[0]
+		return path, strings.TrimPrefix(filepath.Base(path), prefix), func() { os.Remove(path) }, nil
+	}
+
+	// "Title.en.srt" -> "Title"
+	base := filepath.Base(files[0])
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+
+	path = filepath.Join(tempDir, base+" (subtitles).zip")
+	err = zipFiles(files, path, prefix)
+	for _, f := range files {
+		os.Remove(f)
+	}
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to pack subtitles: %w", err)
+	}
+	return path, strings.TrimPrefix(filepath.Base(path), prefix), func() { os.Remove(path) }, nil
+}
@@ -0,0 +1,216 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrThumbnailNotAllowed = errors.New("thumbnail host not allowed")
+	ErrThumbnailNotFound   = errors.New("thumbnail not found")
+	ErrThumbnailInvalid    = errors.New("thumbnail response rejected")
+	ErrBlockedAddress      = errors.New("address not allowed")
+)
+
+// DefaultThumbnailHosts are the CDNs the platforms serve thumbnails from. An
+// entry matches its host exactly; "*." entries match any subdomain.
+var DefaultThumbnailHosts = []string{
+	"*.ytimg.com",
+	"img.youtube.com",
+	"yt3.ggpht.com",
+	"yt3.googleusercontent.com",
+	"*.cdninstagram.com",
+	"*.fbcdn.net",
+	"*.tiktokcdn.com",
+	"*.tiktokcdn-us.com",
+}
+
+// thumbnailReferers are the Referer each platform's CDN expects, by host
+// suffix
+var thumbnailReferers = []struct {
+	suffix  string
+	referer string
+}{
+	{"ytimg.com", "https://www.youtube.com/"},
+	{"youtube.com", "https://www.youtube.com/"},
+	{"ggpht.com", "https://www.youtube.com/"},
+	{"googleusercontent.com", "https://www.youtube.com/"},
+	{"cdninstagram.com", "https://www.instagram.com/"},
+	{"fbcdn.net", "https://www.instagram.com/"},
+	{"tiktokcdn.com", "https://www.tiktok.com/"},
+	{"tiktokcdn-us.com", "https://www.tiktok.com/"},
+}
+
+// thumbnailTypes are the content types passed through
+var thumbnailTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+	"image/gif":  true,
+	"image/avif": true,
+}
+
+const maxThumbnailRedirects = 3
+
+// Ranges that are not publicly routable beyond what netip reports
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"), // Benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64 can reach private IPv4
+}
+
+// isPublicAddr reports whether addr may be fetched from
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// ThumbnailFetcher fetches thumbnails for the proxy without letting it reach
+// internal addresses: hosts must be on the allowlist, every redirect hop is
+// checked again, and resolved IPs are checked when dialing, so DNS can't
+// point an allowed name at the internal network.
+type ThumbnailFetcher struct {
+	client  *http.Client
+	hosts   []string
+	maxSize int64
+}
+
+func NewThumbnailFetcher(hosts []string, maxSize int64) *ThumbnailFetcher {
+	f := &ThumbnailFetcher{
+		hosts:   hosts,
+		maxSize: maxSize,
+	}
+
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil || !isPublicAddr(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", ErrBlockedAddress, address)
+			}
+			return nil
+		},
+	}
+	f.client = &http.Client{
+		// No proxy: the dial check must see the thumbnail host's address
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        20,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxThumbnailRedirects {
+				return fmt.Errorf("%w: too many redirects", ErrThumbnailInvalid)
+			}
+			if !f.Allowed(req.URL) {
+				return fmt.Errorf("%w: redirect to %s", ErrThumbnailNotAllowed, req.URL.Host)
+			}
+			setThumbnailHeaders(req)
+			return nil
+		},
+	}
+	return f
+}
+
+// Allowed reports whether u is an https URL on an allowed host
+func (f *ThumbnailFetcher) Allowed(u *url.URL) bool {
+	if u.Scheme != "https" || u.User != nil || u.Port() != "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range f.hosts {
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch downloads the thumbnail at rawURL, returning its body and content
+// type
+func (f *ThumbnailFetcher) Fetch(ctx context.Context, rawURL string) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || !f.Allowed(u) {
+		return nil, "", ErrThumbnailNotAllowed
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	setThumbnailHeaders(req)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%w: status %d", ErrThumbnailNotFound, resp.StatusCode)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !thumbnailTypes[mediaType] {
+		return nil, "", fmt.Errorf("%w: content type %q", ErrThumbnailInvalid, resp.Header.Get("Content-Type"))
+	}
+	if resp.ContentLength > f.maxSize {
+		return nil, "", fmt.Errorf("%w: %d bytes", ErrThumbnailInvalid, resp.ContentLength)
+	}
+
+	var body bytes.Buffer
+	n, err := io.Copy(&body, io.LimitReader(resp.Body, f.maxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if n > f.maxSize {
+		return nil, "", fmt.Errorf("%w: larger than %d bytes", ErrThumbnailInvalid, f.maxSize)
+	}
+	return body.Bytes(), mediaType, nil
+}
+
+// setThumbnailHeaders makes the request look like the platform's own page
+// loading the image
+func setThumbnailHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
+	req.Header.Set("Accept", "image/avif,image/webp,image/*")
+	req.Header.Del("Referer")
+
+	host := strings.ToLower(req.URL.Hostname())
+	for _, r := range thumbnailReferers {
+		if host == r.suffix || strings.HasSuffix(host, "."+r.suffix) {
+			req.Header.Set("Referer", r.referer)
+			return
+		}
+	}
+}
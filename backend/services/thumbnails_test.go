@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"testing"
+)
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"142.250.74.110", true},
+		{"2a00:1450:4001:82a::200e", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false}, // Cloud metadata
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"198.18.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},     // IPv4-mapped loopback
+		{"::ffff:10.0.0.1", false},      // IPv4-mapped private
+		{"::ffff:142.250.74.110", true}, // IPv4-mapped public
+		{"64:ff9b::a00:1", false},       // NAT64 of 10.0.0.1
+		{"64:ff9b::8efa:4a6e", false},   // NAT64 is rejected whatever it maps to
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := isPublicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Fatalf("isPublicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThumbnailFetcherAllowed(t *testing.T) {
+	f := NewThumbnailFetcher(DefaultThumbnailHosts, 1<<20)
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://i.ytimg.com/vi/dQw4w9WgXcQ/hqdefault.jpg", true},
+		{"https://I.YTIMG.COM/vi/x.jpg", true},
+		{"https://img.youtube.com/vi/x/0.jpg", true},
+		{"https://scontent.cdninstagram.com/x.jpg", true},
+		{"http://i.ytimg.com/vi/x.jpg", false},
+		{"https://ytimg.com/vi/x.jpg", false}, // "*." needs a subdomain
+		{"https://i.ytimg.com.attacker.net/x.jpg", false},
+		{"https://attacker-ytimg.com/x.jpg", false},
+		{"https://sub.img.youtube.com/x.jpg", false}, // Exact entries match exactly
+		{"https://i.ytimg.com:8443/x.jpg", false},
+		{"https://user@i.ytimg.com/x.jpg", false},
+		{"https://127.0.0.1/x.jpg", false},
+		{"https://[::1]/x.jpg", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Allowed(u); got != tt.want {
+				t.Fatalf("Allowed(%s) = %v, want %v", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThumbnailFetcherRedirects(t *testing.T) {
+	f := NewThumbnailFetcher(DefaultThumbnailHosts, 1<<20)
+	first, _ := http.NewRequest(http.MethodGet, "https://i.ytimg.com/vi/x/hqdefault.jpg", nil)
+
+	tests := []struct {
+		name   string
+		target string
+		hops   int
+		want   error
+	}{
+		{"allowed host", "https://i9.ytimg.com/vi/x/hqdefault.jpg", 1, nil},
+		{"disallowed host", "https://metadata.google.internal/computeMetadata/v1/", 1, ErrThumbnailNotAllowed},
+		{"downgrade to http", "http://i9.ytimg.com/vi/x/hqdefault.jpg", 1, ErrThumbnailNotAllowed},
+		{"internal IP", "https://169.254.169.254/latest/meta-data/", 1, ErrThumbnailNotAllowed},
+		{"too many redirects", "https://i9.ytimg.com/vi/x/hqdefault.jpg", maxThumbnailRedirects + 1, ErrThumbnailInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, tt.target, nil)
+			via := make([]*http.Request, tt.hops)
+			for i := range via {
+				via[i] = first
+			}
+			if err := f.client.CheckRedirect(req, via); !errors.Is(err, tt.want) {
+				t.Fatalf("CheckRedirect error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestThumbnailFetcherBlocksInternalDials(t *testing.T) {
+	f := NewThumbnailFetcher(DefaultThumbnailHosts, 1<<20)
+	dial := f.client.Transport.(*http.Transport).DialContext
+	for _, address := range []string{"127.0.0.1:443", "[::1]:443", "10.0.0.1:443", "[::ffff:169.254.169.254]:443"} {
+		conn, err := dial(context.Background(), "tcp", address)
+		if conn != nil {
+			conn.Close()
+		}
+		if !errors.Is(err, ErrBlockedAddress) {
+			t.Fatalf("dial %s error = %v, want ErrBlockedAddress", address, err)
+		}
+	}
+}
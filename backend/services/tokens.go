@@ -0,0 +1,131 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid download token")
+	ErrTokenExpired = errors.New("download token expired")
+)
+
+// SigningKey is an HMAC key identified by ID, so tokens name the key they
+// were signed with
+type SigningKey struct {
+	ID     string
+	Secret []byte
+}
+
+// DownloadClaims bind a download to a format offered by Analyze
+type DownloadClaims struct {
+	URL      string `json:"u"`
+	FormatID string `json:"f"`
+	Type     string `json:"t,omitempty"`
+	Client   string `json:"c"`
+	Expires  int64  `json:"e"` // Unix seconds
+}
+
+// TokenSigner signs and verifies download tokens of the form
+// "<key id>.<base64 claims>.<base64 HMAC-SHA256>". The first key signs;
+// all keys verify, so a new key can be put first while tokens signed with
+// the old one are still honored.
+type TokenSigner struct {
+	keys []SigningKey
+	ttl  time.Duration
+}
+
+// NewTokenSigner creates a signer. Without keys, a random key is generated,
+// so tokens don't survive a restart.
+func NewTokenSigner(keys []SigningKey, ttl time.Duration) (*TokenSigner, error) {
+	if len(keys) == 0 {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		keys = []SigningKey{{ID: "auto", Secret: secret}}
+	}
+	for _, k := range keys {
+		if k.ID == "" || strings.Contains(k.ID, ".") || len(k.Secret) < 16 {
+			return nil, fmt.Errorf("download token key %q: ID must be non-empty without dots and the secret at least 16 bytes", k.ID)
+		}
+	}
+	return &TokenSigner{keys: keys, ttl: ttl}, nil
+}
+
+// ParseSigningKeys parses "id:secret,id2:secret2"
+func ParseSigningKeys(s string) ([]SigningKey, error) {
+	var keys []SigningKey
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("download token key %q: expected id:secret", entry)
+		}
+		keys = append(keys, SigningKey{ID: id, Secret: []byte(secret)})
+	}
+	return keys, nil
+}
+
+// Sign returns a token for claims, expiring after the signer's TTL
+func (s *TokenSigner) Sign(claims DownloadClaims) string {
+	claims.Expires = time.Now().Add(s.ttl).Unix()
+	payload, _ := json.Marshal(claims)
+
+	key := s.keys[0]
+	signed := key.ID + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(key.Secret, signed))
+}
+
+// Verify checks the token's signature and expiry and returns its claims
+func (s *TokenSigner) Verify(token string) (*DownloadClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var key *SigningKey
+	for i := range s.keys {
+		if s.keys[i].ID == parts[0] {
+			key = &s.keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return nil, ErrInvalidToken
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(mac, sign(key.Secret, parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims DownloadClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return nil, ErrTokenExpired
+	}
+	return &claims, nil
+}
+
+func sign(secret []byte, data string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
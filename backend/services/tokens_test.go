@@ -0,0 +1,84 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T, ttl time.Duration, keys ...SigningKey) *TokenSigner {
+	t.Helper()
+	s, err := NewTokenSigner(keys, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestTokenSignerVerify(t *testing.T) {
+	oldKey := SigningKey{ID: "old", Secret: []byte("0123456789abcdef-old")}
+	newKey := SigningKey{ID: "new", Secret: []byte("0123456789abcdef-new")}
+	claims := DownloadClaims{URL: "https://www.youtube.com/watch?v=dQw4w9WgXcQ", FormatID: "137", Client: "203.0.113.7"}
+
+	signer := newTestSigner(t, time.Minute, newKey, oldKey)
+	token := signer.Sign(claims)
+	parts := strings.Split(token, ".")
+
+	// A payload granting another format, re-encoded under the original MAC
+	forged := claims
+	forged.FormatID = "best"
+	forged.Expires = time.Now().Add(time.Minute).Unix()
+	forgedPayload, _ := json.Marshal(forged)
+
+	badMAC := []byte(parts[2])
+	if badMAC[0] == 'A' {
+		badMAC[0] = 'B'
+	} else {
+		badMAC[0] = 'A'
+	}
+
+	tests := []struct {
+		name   string
+		signer *TokenSigner
+		token  string
+		want   error
+	}{
+		{"valid", signer, token, nil},
+		{"signed with the old key after rotation", signer, newTestSigner(t, time.Minute, oldKey).Sign(claims), nil},
+		{"old key dropped", newTestSigner(t, time.Minute, newKey), newTestSigner(t, time.Minute, oldKey).Sign(claims), ErrInvalidToken},
+		{"unknown key ID", signer, "other." + parts[1] + "." + parts[2], ErrInvalidToken},
+		{"key ID swapped", signer, "old." + parts[1] + "." + parts[2], ErrInvalidToken},
+		{"tampered payload", signer, parts[0] + "." + base64.RawURLEncoding.EncodeToString(forgedPayload) + "." + parts[2], ErrInvalidToken},
+		{"tampered signature", signer, parts[0] + "." + parts[1] + "." + string(badMAC), ErrInvalidToken},
+		{"missing signature", signer, parts[0] + "." + parts[1], ErrInvalidToken},
+		{"extra part", signer, token + ".x", ErrInvalidToken},
+		{"empty", signer, "", ErrInvalidToken},
+		{"expired", signer, newTestSigner(t, -time.Second, newKey).Sign(claims), ErrTokenExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.signer.Verify(tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Verify error = %v, want %v", err, tt.want)
+			}
+			if err == nil && (got.URL != claims.URL || got.FormatID != claims.FormatID || got.Client != claims.Client) {
+				t.Fatalf("Verify claims = %+v, want %+v", got, claims)
+			}
+		})
+	}
+}
+
+func TestNewTokenSignerRejectsWeakKeys(t *testing.T) {
+	for _, key := range []SigningKey{
+		{ID: "", Secret: []byte("0123456789abcdef")},
+		{ID: "a.b", Secret: []byte("0123456789abcdef")},
+		{ID: "short", Secret: []byte("too short")},
+	} {
+		if _, err := NewTokenSigner([]SigningKey{key}, time.Minute); err == nil {
+			t.Fatalf("key %q was accepted", key.ID)
+		}
+	}
+}
@@ -16,38 +16,196 @@ const (
 	PlatformUnknown   Platform = "unknown"
 )
 
+// MediaKind is what a link points at
+type MediaKind string
+
+const (
+	KindVideo    MediaKind = "video"
+	KindShort    MediaKind = "short"
+	KindReel     MediaKind = "reel"
+	KindPlaylist MediaKind = "playlist"
+	KindChannel  MediaKind = "channel"
+)
+
+// Downloadable reports whether the kind is a single video
+func (k MediaKind) Downloadable() bool {
+	return k == KindVideo || k == KindShort || k == KindReel
+}
+
 var (
 	ErrInvalidURL     = errors.New("invalid URL")
 	ErrUnsupportedURL = errors.New("unsupported platform")
 )
 
-var platformPatterns = map[Platform]*regexp.Regexp{
-	PlatformYouTube:   regexp.MustCompile(`(?i)(youtube\.com|youtu\.be|music\.youtube\.com)`),
-	PlatformInstagram: regexp.MustCompile(`(?i)(instagram\.com|instagr\.am)`),
-	PlatformTikTok:    regexp.MustCompile(`(?i)(tiktok\.com|vm\.tiktok\.com)`),
+// MediaRef identifies the media behind a link. Different links to the same
+// video (youtu.be, m., music., shorts, tracking parameters) have the same
+// ref; URL is the canonical link handed to yt-dlp.
+type MediaRef struct {
+	Platform Platform  `json:"platform"`
+	Kind     MediaKind `json:"kind"`
+	ID       string    `json:"id"`
+	URL      string    `json:"url"`
+}
+
+// Key identifies the media in caches. Shorts and reels share keys with the
+// same video linked as a regular one.
+func (r *MediaRef) Key() string {
+	if r.Kind.Downloadable() {
+		return string(r.Platform) + ":" + r.ID
+	}
+	return string(r.Platform) + ":" + string(r.Kind) + ":" + r.ID
+}
+
+// platformHosts are the exact hosts accepted for each platform
+var platformHosts = map[string]Platform{
+	"youtube.com":              PlatformYouTube,
+	"www.youtube.com":          PlatformYouTube,
+	"m.youtube.com":            PlatformYouTube,
+	"music.youtube.com":        PlatformYouTube,
+	"youtu.be":                 PlatformYouTube,
+	"youtube-nocookie.com":     PlatformYouTube,
+	"www.youtube-nocookie.com": PlatformYouTube,
+	"instagram.com":            PlatformInstagram,
+	"www.instagram.com":        PlatformInstagram,
+	"instagr.am":               PlatformInstagram,
+	"tiktok.com":               PlatformTikTok,
+	"www.tiktok.com":           PlatformTikTok,
+	"m.tiktok.com":             PlatformTikTok,
+	"vm.tiktok.com":            PlatformTikTok,
+	"vt.tiktok.com":            PlatformTikTok,
 }
 
+var (
+	youtubeIDPattern      = regexp.MustCompile(`^[\w-]{11}$`)
+	youtubeVideoPath      = regexp.MustCompile(`^/(shorts|live|embed|v)/([\w-]{11})/?$`)
+	youtubePlaylistID     = regexp.MustCompile(`^[\w-]+$`)
+	youtubeChannelPath    = regexp.MustCompile(`^/(@[\w.-]+|channel/UC[\w-]{22}|c/[\w.-]+|user/[\w.-]+)(?:/(?:videos|shorts|streams|featured))?/?$`)
+	instagramMediaPath    = regexp.MustCompile(`^/(?:[\w.]+/)?(p|reels?|tv)/([\w-]+)/?$`)
+	instagramProfilePath  = regexp.MustCompile(`^/([\w.]+)/?$`)
+	tiktokVideoPath       = regexp.MustCompile(`^/(@[\w.-]+)/video/(\d+)/?$`)
+	tiktokEmbedPath       = regexp.MustCompile(`^/embed(?:/v2)?/(\d+)/?$`)
+	tiktokProfilePath     = regexp.MustCompile(`^/(@[\w.-]+)/?$`)
+	tiktokShortLinkPath   = regexp.MustCompile(`^/(?:t/)?([\w-]+)/?$`)
+	instagramReservedPath = map[string]bool{"explore": true, "accounts": true, "stories": true, "direct": true, "p": true, "reel": true, "reels": true, "tv": true}
+)
+
 type Validator struct{}
 
 func NewValidator() *Validator {
 	return &Validator{}
 }
 
-func (v *Validator) ValidateURL(rawURL string) (Platform, error) {
-	rawURL = strings.TrimSpace(rawURL)
-	
-	parsed, err := url.Parse(rawURL)
+// ValidateURL parses a link to a supported platform into a MediaRef. Only
+// http(s) links on the platforms' own hosts are accepted, without
+// credentials or non-default ports.
+func (v *Validator) ValidateURL(rawURL string) (*MediaRef, error) {
+	parsed, err := url.Parse(strings.TrimSpace(rawURL))
 	if err != nil || parsed.Host == "" {
-		return PlatformUnknown, ErrInvalidURL
+		return nil, ErrInvalidURL
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, ErrInvalidURL
+	}
+	if parsed.User != nil {
+		return nil, ErrInvalidURL
+	}
+	switch parsed.Port() {
+	case "", "80", "443":
+	default:
+		return nil, ErrInvalidURL
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+	platform, ok := platformHosts[host]
+	if !ok {
+		return nil, ErrUnsupportedURL
+	}
+
+	var ref *MediaRef
+	switch platform {
+	case PlatformYouTube:
+		ref = youtubeRef(host, parsed)
+	case PlatformInstagram:
+		ref = instagramRef(parsed)
+	case PlatformTikTok:
+		ref = tiktokRef(host, parsed)
+	}
+	if ref == nil {
+		return nil, ErrUnsupportedURL
+	}
+	ref.Platform = platform
+	return ref, nil
+}
+
+func youtubeRef(host string, u *url.URL) *MediaRef {
+	video := func(id string) *MediaRef {
+		return &MediaRef{Kind: KindVideo, ID: id, URL: "https://www.youtube.com/watch?v=" + id}
 	}
 
-	for platform, pattern := range platformPatterns {
-		if pattern.MatchString(parsed.Host) {
-			return platform, nil
+	if host == "youtu.be" {
+		id := strings.Trim(u.Path, "/")
+		if !youtubeIDPattern.MatchString(id) {
+			return nil
 		}
+		return video(id)
 	}
 
-	return PlatformUnknown, ErrUnsupportedURL
+	switch path := strings.TrimSuffix(u.Path, "/"); path {
+	case "/watch":
+		if id := u.Query().Get("v"); youtubeIDPattern.MatchString(id) {
+			return video(id)
+		}
+		return nil
+	case "/playlist":
+		id := u.Query().Get("list")
+		if !youtubePlaylistID.MatchString(id) {
+			return nil
+		}
+		return &MediaRef{Kind: KindPlaylist, ID: id, URL: "https://www.youtube.com/playlist?list=" + id}
+	}
+
+	if m := youtubeVideoPath.FindStringSubmatch(u.Path); m != nil {
+		if m[1] == "shorts" {
+			return &MediaRef{Kind: KindShort, ID: m[2], URL: "https://www.youtube.com/shorts/" + m[2]}
+		}
+		return video(m[2])
+	}
+	if m := youtubeChannelPath.FindStringSubmatch(u.Path); m != nil {
+		return &MediaRef{Kind: KindChannel, ID: m[1], URL: "https://www.youtube.com/" + m[1]}
+	}
+	return nil
 }
 
+func instagramRef(u *url.URL) *MediaRef {
+	if m := instagramMediaPath.FindStringSubmatch(u.Path); m != nil {
+		if m[1] == "p" || m[1] == "tv" {
+			return &MediaRef{Kind: KindVideo, ID: m[2], URL: "https://www.instagram.com/" + m[1] + "/" + m[2] + "/"}
+		}
+		return &MediaRef{Kind: KindReel, ID: m[2], URL: "https://www.instagram.com/reel/" + m[2] + "/"}
+	}
+	if m := instagramProfilePath.FindStringSubmatch(u.Path); m != nil && !instagramReservedPath[m[1]] {
+		return &MediaRef{Kind: KindChannel, ID: m[1], URL: "https://www.instagram.com/" + m[1] + "/"}
+	}
+	return nil
+}
 
+func tiktokRef(host string, u *url.URL) *MediaRef {
+	if host == "vm.tiktok.com" || host == "vt.tiktok.com" || strings.HasPrefix(u.Path, "/t/") {
+		// Short links redirect to a video whose ID isn't known until resolved
+		m := tiktokShortLinkPath.FindStringSubmatch(u.Path)
+		if m == nil {
+			return nil
+		}
+		return &MediaRef{Kind: KindVideo, ID: "link:" + m[1], URL: "https://" + host + u.EscapedPath()}
+	}
+	if m := tiktokVideoPath.FindStringSubmatch(u.Path); m != nil {
+		return &MediaRef{Kind: KindVideo, ID: m[2], URL: "https://www.tiktok.com/" + m[1] + "/video/" + m[2]}
+	}
+	if m := tiktokEmbedPath.FindStringSubmatch(u.Path); m != nil {
+		return &MediaRef{Kind: KindVideo, ID: m[1], URL: "https://www.tiktok.com/embed/v2/" + m[1]}
+	}
+	if m := tiktokProfilePath.FindStringSubmatch(u.Path); m != nil {
+		return &MediaRef{Kind: KindChannel, ID: m[1], URL: "https://www.tiktok.com/" + m[1]}
+	}
+	return nil
+}
@@ -1,10 +1,13 @@
 package services
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -19,58 +22,185 @@ type Format struct {
 	Quality string `json:"quality"`
 	Ext     string `json:"ext"`
 	Size    int64  `json:"size,omitempty"`
+
+	// SizeApprox is set when Size is yt-dlp's estimate from the bitrate
+	SizeApprox   bool    `json:"size_approx,omitempty"`
+	VCodec       string  `json:"vcodec,omitempty"`
+	ACodec       string  `json:"acodec,omitempty"`
+	Width        int     `json:"width,omitempty"`
+	Height       int     `json:"height,omitempty"`
+	FPS          float64 `json:"fps,omitempty"`
+	DynamicRange string  `json:"dynamic_range,omitempty"`
+	TBR          float64 `json:"tbr,omitempty"` // Total bitrate, kbps
+	Language     string  `json:"language,omitempty"`
+
+	// Conversion applied on download, passed back as download options.
+	// Conversion is remux or transcode for video that doesn't play natively
+	// as MP4, empty otherwise.
+	AudioFormat  string `json:"audio_format,omitempty"`
+	AudioBitrate int    `json:"audio_bitrate,omitempty"`
+	Conversion   string `json:"conversion,omitempty"`
+
+	// Token authorizes downloading this format, see TokenSigner
+	Token string `json:"token,omitempty"`
 }
 
 type VideoInfo struct {
-	Platform  Platform `json:"platform"`
-	Title     string   `json:"title"`
-	Duration  int      `json:"duration"`
-	Thumbnail string   `json:"thumbnail"`
-	Formats   []Format `json:"formats"`
+	Platform  Platform        `json:"platform"`
+	Title     string          `json:"title"`
+	Duration  int             `json:"duration"`
+	Thumbnail string          `json:"thumbnail"`
+	Formats   []Format        `json:"formats"`
+	Tags      Tags            `json:"tags"` // Tags written by default with EmbedMetadata
+	Chapters  []Chapter       `json:"chapters,omitempty"`
+	Subtitles []SubtitleTrack `json:"subtitles,omitempty"`
+
+	// RawInfo is yt-dlp's --dump-json output the result was built from
+	RawInfo json.RawMessage `json:"-"`
 }
 
+// analyzeTimeout bounds a single extraction, which keeps running for other
+// waiters when the request that started it goes away
+const analyzeTimeout = 2 * time.Minute
+
 type YtDlpService struct {
 	ytdlpPath   string
+	ffmpegPath  string
 	cookiesFile string
 	proxyURL    string
+	httpClient  *http.Client
 	validator   *Validator
+	cache       *AnalyzeCache
+	files       *FileCache
+	resolutions []int
+	presets     []Preset
+	analyzing   flightGroup[*VideoInfo]
+	downloading flightGroup[*cachedFile]
 }
 
-func NewYtDlpService(ytdlpPath, cookiesFile, proxyURL string, validator *Validator) *YtDlpService {
+// NewYtDlpService creates the service. resolutions is the ladder of heights
+// offered by GetBestFormats, ascending; presets are the output profiles
+// downloads can be transcoded to.
+func NewYtDlpService(ytdlpPath, ffmpegPath, cookiesFile, proxyURL string, validator *Validator, cache *AnalyzeCache, files *FileCache, resolutions []int, presets []Preset) *YtDlpService {
 	return &YtDlpService{
 		ytdlpPath:   ytdlpPath,
+		ffmpegPath:  ffmpegPath,
 		cookiesFile: cookiesFile,
 		proxyURL:    proxyURL,
+		httpClient:  NewHTTPClient(proxyURL),
 		validator:   validator,
+		cache:       cache,
+		files:       files,
+		resolutions: resolutions,
+		presets:     presets,
+	}
+}
+
+// Presets returns the configured output presets
+func (s *YtDlpService) Presets() []Preset {
+	return s.presets
+}
+
+// ValidateOptions checks opts, including that a preset exists
+func (s *YtDlpService) ValidateOptions(opts DownloadOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
 	}
+	if opts.Preset != "" {
+		if _, err := s.preset(opts.Preset); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type ytdlpFormat struct {
-	FormatID   string  `json:"format_id"`
-	Ext        string  `json:"ext"`
-	Resolution string  `json:"resolution"`
-	VCodec     string  `json:"vcodec"`
-	ACodec     string  `json:"acodec"`
-	Filesize   int64   `json:"filesize"`
-	ABR        float64 `json:"abr"`
-	Height     int     `json:"height"`
-	FormatNote string  `json:"format_note"`
+	FormatID       string  `json:"format_id"`
+	Ext            string  `json:"ext"`
+	Resolution     string  `json:"resolution"`
+	VCodec         string  `json:"vcodec"`
+	ACodec         string  `json:"acodec"`
+	Filesize       int64   `json:"filesize"`
+	FilesizeApprox float64 `json:"filesize_approx"`
+	ABR            float64 `json:"abr"`
+	TBR            float64 `json:"tbr"`
+	Width          int     `json:"width"`
+	Height         int     `json:"height"`
+	FPS            float64 `json:"fps"`
+	DynamicRange   string  `json:"dynamic_range"`
+	Language       string  `json:"language"`
+	FormatNote     string  `json:"format_note"`
 }
 
 type ytdlpInfo struct {
-	Title     string        `json:"title"`
-	Duration  float64       `json:"duration"`
-	Thumbnail string        `json:"thumbnail"`
-	Formats   []ytdlpFormat `json:"formats"`
-	Extractor string        `json:"extractor"`
+	Title     string         `json:"title"`
+	Duration  float64        `json:"duration"`
+	Thumbnail string         `json:"thumbnail"`
+	Formats   []ytdlpFormat  `json:"formats"`
+	Extractor string         `json:"extractor"`
+	Chapters  []ytdlpChapter `json:"chapters"`
+
+	Subtitles         map[string][]ytdlpSubtitle `json:"subtitles"`
+	AutomaticCaptions map[string][]ytdlpSubtitle `json:"automatic_captions"`
+
+	// Music metadata, set by YouTube Music and some other extractors
+	Uploader    string `json:"uploader"`
+	Artist      string `json:"artist"`
+	Album       string `json:"album"`
+	Track       string `json:"track"`
+	TrackNumber int    `json:"track_number"`
+	UploadDate  string `json:"upload_date"`
 }
 
+// Analyze extracts video info. Results are cached per video, and concurrent
+// calls for the same video share a single yt-dlp run.
 func (s *YtDlpService) Analyze(ctx context.Context, url string) (*VideoInfo, error) {
-	platform, err := s.validator.ValidateURL(url)
+	ref, err := s.mediaRef(url)
+	if err != nil {
+		return nil, err
+	}
+	key := ref.Key()
+
+	if info, ok := s.cache.Get(key); ok {
+		return info, nil
+	}
+
+	return s.analyzing.Do(ctx, key, func(ctx context.Context) (*VideoInfo, error) {
+		ctx, cancel := context.WithTimeout(ctx, analyzeTimeout)
+		defer cancel()
+
+		info, err := s.analyze(ctx, ref.URL, ref.Platform)
+		if err != nil {
+			return nil, err
+		}
+		s.cache.Set(key, info)
+		return info, nil
+	})
+}
+
+// ForgetAnalysis drops the cached Analyze result for the video behind url
+func (s *YtDlpService) ForgetAnalysis(url string) error {
+	ref, err := s.mediaRef(url)
+	if err != nil {
+		return err
+	}
+	s.cache.Delete(ref.Key())
+	return nil
+}
+
+// mediaRef validates url and checks that it links to a single video
+func (s *YtDlpService) mediaRef(url string) (*MediaRef, error) {
+	ref, err := s.validator.ValidateURL(url)
 	if err != nil {
 		return nil, err
 	}
+	if !ref.Kind.Downloadable() {
+		return nil, fmt.Errorf("%w: %s links aren't supported, only single videos", ErrUnsupportedURL, ref.Kind)
+	}
+	return ref, nil
+}
 
+func (s *YtDlpService) analyze(ctx context.Context, url string, platform Platform) (*VideoInfo, error) {
 	args := []string{
 		"--dump-json",
 		"--no-download",
@@ -96,10 +226,7 @@ func (s *YtDlpService) Analyze(ctx context.Context, url string) (*VideoInfo, err
 
 	output, err := cmd.Output()
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return nil, fmt.Errorf("yt-dlp error: %s", string(exitErr.Stderr))
-		}
-		return nil, fmt.Errorf("failed to execute yt-dlp: %w", err)
+		return nil, ytdlpFailure("yt-dlp error", err, nil)
 	}
 
 	var info ytdlpInfo
@@ -117,12 +244,35 @@ func (s *YtDlpService) Analyze(ctx context.Context, url string) (*VideoInfo, err
 		Duration:  duration,
 		Thumbnail: info.Thumbnail,
 		Formats:   formats,
+		Tags:      info.tags(),
+		Chapters:  parseChapters(info.Chapters),
+		Subtitles: parseSubtitles(info.Subtitles, info.AutomaticCaptions),
+		RawInfo:   output,
 	}, nil
 }
 
+// tags returns the tags yt-dlp's FFmpegMetadata writes for the video, with
+// the same fallbacks
+func (info *ytdlpInfo) tags() Tags {
+	tags := Tags{
+		Title:  info.Track,
+		Artist: info.Artist,
+		Album:  info.Album,
+		Date:   info.UploadDate,
+		Track:  info.TrackNumber,
+	}
+	if tags.Title == "" {
+		tags.Title = info.Title
+	}
+	if tags.Artist == "" {
+		tags.Artist = info.Uploader
+	}
+	return tags
+}
+
 func (s *YtDlpService) parseFormats(ytFormats []ytdlpFormat) []Format {
 	var formats []Format
-	seen := make(map[string]bool)
+	seen := make(map[string]int) // Index in formats by type, quality and ext
 
 	for _, f := range ytFormats {
 		if f.FormatID == "" {
@@ -140,12 +290,14 @@ func (s *YtDlpService) parseFormats(ytFormats []ytdlpFormat) []Format {
 			}
 		} else if f.VCodec != "none" {
 			formatType = "video"
-			// Prefer only mp4 container for better compatibility on Windows
-			if f.Ext != "mp4" {
-				continue
-			}
 			if f.Height > 0 {
 				quality = fmt.Sprintf("%dp", f.Height)
+				if f.FPS > 30 {
+					quality += fmt.Sprintf("%.0f", f.FPS)
+				}
+				if isHDR(f.DynamicRange) {
+					quality += " HDR"
+				}
 			} else if f.Resolution != "" && f.Resolution != "audio only" {
 				quality = f.Resolution
 			} else {
@@ -155,44 +307,164 @@ func (s *YtDlpService) parseFormats(ytFormats []ytdlpFormat) []Format {
 			continue
 		}
 
+		format := Format{
+			ID:       f.FormatID,
+			Type:     formatType,
+			Quality:  quality,
+			Ext:      f.Ext,
+			Size:     f.Filesize,
+			VCodec:   codecName(f.VCodec),
+			ACodec:   codecName(f.ACodec),
+			TBR:      f.TBR,
+			Language: f.Language,
+		}
+		if format.Size == 0 && f.FilesizeApprox > 0 {
+			format.Size = int64(f.FilesizeApprox)
+			format.SizeApprox = true
+		}
+		if formatType == "video" {
+			format.Width = f.Width
+			format.Height = f.Height
+			format.FPS = f.FPS
+			format.DynamicRange = f.DynamicRange
+			format.Conversion = conversionFor(f.Ext, format.VCodec, format.ACodec)
+		}
+
+		// yt-dlp lists formats from worst to best, so of duplicates keep the
+		// one with the highest bitrate
 		key := fmt.Sprintf("%s-%s-%s", formatType, quality, f.Ext)
-		if seen[key] {
+		if i, ok := seen[key]; ok {
+			if format.TBR > formats[i].TBR {
+				formats[i] = format
+			}
 			continue
 		}
-		seen[key] = true
-
-		formats = append(formats, Format{
-			ID:      f.FormatID,
-			Type:    formatType,
-			Quality: quality,
-			Ext:     f.Ext,
-			Size:    f.Filesize,
-		})
+		seen[key] = len(formats)
+		formats = append(formats, format)
 	}
 
 	return formats
 }
 
+// codecName drops yt-dlp's "none" marker for a missing stream
+func codecName(codec string) string {
+	if codec == "none" {
+		return ""
+	}
+	return codec
+}
+
+// tempDir holds downloads and info files handed to yt-dlp
+const tempDir = "/tmp/viddown"
+
+// sourceArgs returns the yt-dlp arguments selecting the video. When Analyze
+// has cached info for url, it is written to a temp file and passed with
+// --load-info-json so yt-dlp skips extraction and doesn't hit the platform
+// again; otherwise the canonical url is returned. cleanup removes the temp
+// file.
+func (s *YtDlpService) sourceArgs(url string) (args []string, cleanup func()) {
+	cleanup = func() {}
+
+	ref, err := s.mediaRef(url)
+	if err != nil {
+		return []string{url}, cleanup
+	}
+	info, ok := s.cache.Get(ref.Key())
+	if !ok || len(info.RawInfo) == 0 {
+		return []string{ref.URL}, cleanup
+	}
+
+	path, err := writeInfoFile(info.RawInfo)
+	if err != nil {
+		return []string{ref.URL}, cleanup
+	}
+	return []string{"--load-info-json", path}, func() {
+		os.Remove(path)
+	}
+}
+
+// sourceArgsWithFields is like sourceArgs, but sets fields in the info JSON
+// handed to yt-dlp, e.g. meta_* fields overriding embedded tags. The video is
+// analyzed first if its info isn't cached.
+func (s *YtDlpService) sourceArgsWithFields(ctx context.Context, url string, fields map[string]any) (args []string, cleanup func(), err error) {
+	if len(fields) == 0 {
+		args, cleanup = s.sourceArgs(url)
+		return args, cleanup, nil
+	}
+
+	info, err := s.Analyze(ctx, url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(info.RawInfo, &raw); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse info JSON: %w", err)
+	}
+	for name, value := range fields {
+		raw[name], _ = json.Marshal(value)
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	path, err := writeInfoFile(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write info JSON: %w", err)
+	}
+	return []string{"--load-info-json", path}, func() {
+		os.Remove(path)
+	}, nil
+}
+
+// writeInfoFile writes info JSON to a temp file for --load-info-json
+func writeInfoFile(data []byte) (string, error) {
+	f, err := createTempFile("info_*.json")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// createTempFile creates a file in tempDir
+func createTempFile(pattern string) (*os.File, error) {
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(tempDir, pattern)
+}
+
 // StreamInfo contains information for streaming a video
 type StreamInfo struct {
 	URL         string
 	Filename    string
 	ContentType string
 	Size        int64
+	Headers     map[string]string // HTTP headers the CDN expects
 }
 
-// GetDirectURL gets the direct download URL for a format
+// GetDirectURL gets the direct download URL for a format. URL, filename and
+// request headers are printed by a single yt-dlp call, which reuses cached
+// Analyze info when available.
 func (s *YtDlpService) GetDirectURL(ctx context.Context, url, formatID string) (*StreamInfo, error) {
-	_, err := s.validator.ValidateURL(url)
+	_, err := s.mediaRef(url)
 	if err != nil {
 		return nil, err
 	}
 
-	// Build arguments to get URL and filename
+	// Build arguments to get URL, filename and headers
 	args := []string{
 		"-f", formatID,
-		"--get-url",
-		"--get-filename",
+		"--print", "urls",
+		"--print", "filename",
+		"--print", "%(http_headers)j",
 		"-o", "%(title)s.%(ext)s",
 		"--no-warnings",
 		"--no-playlist",
@@ -211,61 +483,92 @@ func (s *YtDlpService) GetDirectURL(ctx context.Context, url, formatID string) (
 		args = append(args, "--proxy", s.proxyURL)
 	}
 
-	args = append(args, url)
+	source, cleanup := s.sourceArgs(url)
+	defer cleanup()
+
+	args = append(args, source...)
 	cmd := exec.CommandContext(ctx, s.ytdlpPath, args...)
 
 	output, err := cmd.Output()
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return nil, fmt.Errorf("failed to get URL: %s", string(exitErr.Stderr))
-		}
-		return nil, fmt.Errorf("failed to get URL: %w", err)
+		return nil, ytdlpFailure("failed to get URL", err, nil)
 	}
 
 	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	if len(lines) < 2 {
+	if len(lines) < 3 {
 		return nil, fmt.Errorf("invalid yt-dlp output")
 	}
 
-	// Last line is filename, everything before is URLs (could be multiple for merged formats)
-	filename := lines[len(lines)-1]
+	// Last line is headers, then filename, everything before is URLs (could be multiple for merged formats)
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &headers); err != nil {
+		headers = nil
+	}
+	filename := lines[len(lines)-2]
 	directURL := lines[0]
 
-	// Determine content type from extension
-	ext := filepath.Ext(filename)
-	contentType := "application/octet-stream"
-	switch ext {
+	return &StreamInfo{
+		URL:         directURL,
+		Filename:    filename,
+		ContentType: ContentTypeFor(filename),
+		Headers:     headers,
+	}, nil
+}
+
+// RefreshDirectURL gets a new direct URL for a format, bypassing cached
+// Analyze info whose signed URLs may have expired
+func (s *YtDlpService) RefreshDirectURL(ctx context.Context, url, formatID string) (*StreamInfo, error) {
+	if err := s.ForgetAnalysis(url); err != nil {
+		return nil, err
+	}
+	return s.GetDirectURL(ctx, url, formatID)
+}
+
+// ContentTypeFor determines the content type from the file extension
+func ContentTypeFor(filename string) string {
+	switch filepath.Ext(filename) {
 	case ".mp4":
-		contentType = "video/mp4"
+		return "video/mp4"
 	case ".webm":
-		contentType = "video/webm"
+		return "video/webm"
 	case ".m4a":
-		contentType = "audio/mp4"
+		return "audio/mp4"
 	case ".mp3":
-		contentType = "audio/mpeg"
-	case ".opus":
-		contentType = "audio/opus"
+		return "audio/mpeg"
+	case ".opus", ".ogg":
+		return "audio/ogg"
+	case ".flac":
+		return "audio/flac"
+	case ".wav":
+		return "audio/wav"
+	case ".mkv":
+		return "video/x-matroska"
+	case ".zip":
+		return "application/zip"
+	case ".srt":
+		return "application/x-subrip"
+	case ".vtt":
+		return "text/vtt"
+	case ".ass":
+		return "text/x-ssa"
 	}
-
-	return &StreamInfo{
-		URL:         directURL,
-		Filename:    filename,
-		ContentType: contentType,
-	}, nil
+	return "application/octet-stream"
 }
 
-// GetDirectURLs gets direct download URLs for merged formats (video + audio separately)
-func (s *YtDlpService) GetDirectURLs(ctx context.Context, url, formatID string) (videoURL, audioURL, filename string, err error) {
-	_, err = s.validator.ValidateURL(url)
+// GetDirectURLs gets direct download URLs for merged formats (video + audio
+// separately) and the request headers the CDN expects
+func (s *YtDlpService) GetDirectURLs(ctx context.Context, url, formatID string) (videoURL, audioURL, filename string, headers map[string]string, err error) {
+	_, err = s.mediaRef(url)
 	if err != nil {
-		return "", "", "", err
+		return "", "", "", nil, err
 	}
 
-	// Build arguments to get URLs
+	// Build arguments to get URLs, filename and headers
 	args := []string{
 		"-f", formatID,
-		"--get-url",
-		"--get-filename",
+		"--print", "urls",
+		"--print", "filename",
+		"--print", "%(http_headers)j",
 		"-o", "%(title)s.mp4",
 		"--no-warnings",
 		"--no-playlist",
@@ -282,40 +585,208 @@ func (s *YtDlpService) GetDirectURLs(ctx context.Context, url, formatID string)
 		args = append(args, "--proxy", s.proxyURL)
 	}
 
-	args = append(args, url)
+	source, cleanup := s.sourceArgs(url)
+	defer cleanup()
+
+	args = append(args, source...)
 	cmd := exec.CommandContext(ctx, s.ytdlpPath, args...)
 
 	output, err := cmd.Output()
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return "", "", "", fmt.Errorf("failed to get URLs: %s", string(exitErr.Stderr))
-		}
-		return "", "", "", fmt.Errorf("failed to get URLs: %w", err)
+		return "", "", "", nil, ytdlpFailure("failed to get URLs", err, nil)
 	}
 
 	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	if len(lines) < 3 {
-		return "", "", "", fmt.Errorf("invalid yt-dlp output for merged format")
+	if len(lines) < 4 {
+		return "", "", "", nil, fmt.Errorf("invalid yt-dlp output for merged format")
 	}
 
-	// For merged formats: URL1 (video), URL2 (audio), filename
+	// For merged formats: URL1 (video), URL2 (audio), filename, headers
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &headers); err != nil {
+		headers = nil
+	}
 	videoURL = lines[0]
 	audioURL = lines[1]
-	filename = lines[len(lines)-1]
+	filename = lines[len(lines)-2]
+
+	return videoURL, audioURL, filename, headers, nil
+}
+
+// Merge settings; they are part of the file cache key since they change the output
+const (
+	mergeOutputFormat      = "mp4"
+	mergePostprocessorArgs = "Merger+ffmpeg:-c:v copy -c:a aac -strict experimental"
+)
+
+// downloadTimeout bounds a shared download, which keeps running for other
+// waiters when the request that started it goes away, until the last one
+// leaves
+const downloadTimeout = 6 * time.Hour
+
+type cachedFile struct {
+	path     string
+	filename string
+}
+
+// DownloadToFile downloads a format to a temp file, merging video+audio and
+// applying opts (audio conversion etc.) on the way.
+// yt-dlp handles merge with ffmpeg -c:a aac for AAC/Opus compatibility.
+// onProgress, if not nil, receives progress updates parsed from yt-dlp output.
+//
+// When the file cache is enabled, finished files are stored there and served
+// to later requests without running yt-dlp; concurrent requests for the same
+// output share one download, and only the first caller gets progress updates.
+// A cached file is pinned until cleanup is called, so it isn't evicted while
+// in use. key identifies the output by URL, format and options; it stays the
+// same when the file is downloaded again.
+func (s *YtDlpService) DownloadToFile(ctx context.Context, sourceURL, formatID string, opts DownloadOptions, onProgress ProgressFunc) (tempPath, filename, key string, cleanup func(), err error) {
+	if err := s.ValidateOptions(opts); err != nil {
+		return "", "", "", nil, err
+	}
+	if opts, err = s.resolveChapter(ctx, sourceURL, opts); err != nil {
+		return "", "", "", nil, err
+	}
+	if opts.Preset != "" {
+		preset, _ := s.preset(opts.Preset)
+		formatID = preset.formatSelector()
+	}
+	key, err = s.outputCacheKey(sourceURL, formatID, opts)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+	if !s.files.Enabled() {
+		tempPath, filename, cleanup, err = s.produce(ctx, sourceURL, formatID, opts, onProgress)
+		return tempPath, filename, key, cleanup, err
+	}
+
+	for {
+		if path, filename, release, ok := s.files.Acquire(key); ok {
+			return path, filename, key, release, nil
+		}
+		// Another insertion can evict the new file before it is pinned, in
+		// which case it is downloaded again
+		if err := s.downloadToCache(ctx, key, sourceURL, formatID, opts, onProgress); err != nil {
+			return "", "", "", nil, err
+		}
+	}
+}
+
+// downloadToCache produces the output into the file cache under key, sharing
+// the download with concurrent callers
+func (s *YtDlpService) downloadToCache(ctx context.Context, key, sourceURL, formatID string, opts DownloadOptions, onProgress ProgressFunc) error {
+	_, err := s.downloading.Do(ctx, key, func(ctx context.Context) (*cachedFile, error) {
+		ctx, cancel := context.WithTimeout(ctx, downloadTimeout)
+		defer cancel()
 
-	return videoURL, audioURL, filename, nil
+		tempPath, filename, cleanup, err := s.produce(ctx, sourceURL, formatID, opts, onProgress)
+		if err != nil {
+			return nil, err
+		}
+		path, err := s.files.Put(key, tempPath, filename)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		return &cachedFile{path: path, filename: filename}, nil
+	})
+	return err
+}
+
+// IsCached reports whether the output is already in the file cache
+func (s *YtDlpService) IsCached(sourceURL, formatID string, opts DownloadOptions) bool {
+	if !s.files.Enabled() {
+		return false
+	}
+	key, err := s.outputCacheKey(sourceURL, formatID, opts)
+	if err != nil {
+		return false
+	}
+	_, _, ok := s.files.Get(key)
+	return ok
 }
 
-// DownloadMergedToFile downloads merged video+audio to temp file (original strategy)
-// yt-dlp handles merge with ffmpeg -c:a aac for AAC/Opus compatibility
-func (s *YtDlpService) DownloadMergedToFile(ctx context.Context, sourceURL, formatID string) (tempPath string, filename string, cleanup func(), err error) {
-	tempDir := "/tmp/viddown"
+func (s *YtDlpService) outputCacheKey(sourceURL, formatID string, opts DownloadOptions) (string, error) {
+	ref, err := s.mediaRef(sourceURL)
+	if err != nil {
+		return "", err
+	}
+	parts := []string{ref.Key(), formatID, mergeOutputFormat, mergePostprocessorArgs, opts.cacheKey()}
+	if opts.Preset != "" {
+		// Changing a preset's definition invalidates its files
+		preset, err := s.preset(opts.Preset)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, fmt.Sprintf("%+v", *preset))
+	}
+	return CacheKey(parts...), nil
+}
+
+// produce downloads to a temp file and transcodes it when a preset is set
+func (s *YtDlpService) produce(ctx context.Context, sourceURL, formatID string, opts DownloadOptions, onProgress ProgressFunc) (tempPath string, filename string, cleanup func(), err error) {
+	tempPath, filename, cleanup, err = s.downloadToTemp(ctx, sourceURL, formatID, opts, onProgress)
+	if err != nil || opts.Preset == "" {
+		return tempPath, filename, cleanup, err
+	}
+
+	preset, err := s.preset(opts.Preset)
+	if err != nil {
+		cleanup()
+		return "", "", nil, err
+	}
+	duration, err := s.outputDuration(ctx, sourceURL, opts)
+	if err != nil {
+		cleanup()
+		return "", "", nil, err
+	}
+	if onProgress != nil {
+		onProgress(Progress{Phase: PhaseTranscode})
+	}
+
+	transcoded, err := s.transcode(ctx, preset, tempPath, duration, onProgress)
+	if err != nil {
+		cleanup()
+		return "", "", nil, err
+	}
+
+	filename = strings.TrimSuffix(filename, filepath.Ext(filename)) + " [" + preset.Name + "].mp4"
+	return transcoded, filename, func() { os.Remove(transcoded) }, nil
+}
+
+// outputDuration returns the length of the output in seconds, accounting for
+// clips
+func (s *YtDlpService) outputDuration(ctx context.Context, sourceURL string, opts DownloadOptions) (float64, error) {
+	end := opts.End
+	if end == 0 {
+		info, err := s.Analyze(ctx, sourceURL)
+		if err != nil {
+			return 0, err
+		}
+		end = float64(info.Duration)
+	}
+	return end - opts.Start, nil
+}
+
+// downloadToTemp runs yt-dlp into a temp file owned by the caller. The file
+// is named after the video title, behind a prefix unique to this run.
+func (s *YtDlpService) downloadToTemp(ctx context.Context, sourceURL, formatID string, opts DownloadOptions, onProgress ProgressFunc) (tempPath string, filename string, cleanup func(), err error) {
 	if err := os.MkdirAll(tempDir, 0755); err != nil {
 		return "", "", nil, fmt.Errorf("failed to create temp dir: %w", err)
 	}
 
-	prefix := fmt.Sprintf("dl_%d_%%(id)s", time.Now().UnixNano())
-	outputTemplate := filepath.Join(tempDir, prefix+".%(ext)s")
+	runID := time.Now().UnixNano()
+	prefix := fmt.Sprintf("dl_%d_", runID)
+	name := "%(title).200B"
+	if opts.EmbedMetadata && opts.AudioFormat != "" {
+		// Tagged audio is named like a music file; meta_* are the overrides
+		name = "%(meta_artist,artist,uploader).80B - %(meta_title,track,title).120B"
+	}
+	if opts.Chapter > 0 {
+		name += opts.chapterSuffix()
+	} else {
+		name += opts.clipSuffix()
+	}
+	outputTemplate := filepath.Join(tempDir, prefix+name+".%(ext)s")
 
 	args := []string{
 		"-f", formatID,
@@ -324,8 +795,17 @@ func (s *YtDlpService) DownloadMergedToFile(ctx context.Context, sourceURL, form
 		"--no-playlist",
 		"--no-mtime",
 		"--force-overwrites",
-		"--merge-output-format", "mp4",
-		"--postprocessor-args", "ffmpeg:-c:v copy -c:a aac -strict experimental",
+		"--merge-output-format", mergeOutputFormat,
+		"--postprocessor-args", mergePostprocessorArgs,
+	}
+	args = append(args, progressArgs()...)
+	args = append(args, opts.args()...)
+
+	// Split chapters go to their own dir, to be zipped afterwards
+	chapterDir := filepath.Join(tempDir, fmt.Sprintf("chapters_%d", runID))
+	if opts.SplitChapters {
+		defer os.RemoveAll(chapterDir)
+		args = append(args, "-o", "chapter:"+filepath.Join(chapterDir, chapterOutputTemplate))
 	}
 
 	if s.cookiesFile != "" {
@@ -338,23 +818,38 @@ func (s *YtDlpService) DownloadMergedToFile(ctx context.Context, sourceURL, form
 		args = append(args, "--proxy", s.proxyURL)
 	}
 
-	args = append(args, "--force-ipv4", sourceURL)
+	source, cleanupSource, err := s.sourceArgsWithFields(ctx, sourceURL, opts.Tags.metaFields())
+	if err != nil {
+		return "", "", nil, err
+	}
+	defer cleanupSource()
+
+	args = append(args, "--force-ipv4")
+	args = append(args, source...)
 
 	cmd := exec.CommandContext(ctx, s.ytdlpPath, args...)
-	cmd.Stderr = os.Stderr
+	var stderr bytes.Buffer
+	cmd.Stdout = NewProgressParser(onProgress)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
 
 	if err := cmd.Run(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return "", "", nil, fmt.Errorf("yt-dlp failed: %s", string(exitErr.Stderr))
-		}
-		return "", "", nil, fmt.Errorf("yt-dlp failed: %w", err)
+		return "", "", nil, ytdlpFailure("yt-dlp failed", err, stderr.Bytes())
+	}
+
+	if opts.SubtitlesOnly() {
+		return collectSubtitles(prefix)
 	}
 
-	// Find the merged .mp4 file (most recently modified)
-	mp4Matches, _ := filepath.Glob(filepath.Join(tempDir, "dl_*.mp4"))
+	// Find the output file of this run (most recently modified). The glob is
+	// scoped to our unique prefix so concurrent downloads don't pick up each
+	// other's files.
+	matches, _ := filepath.Glob(filepath.Join(tempDir, prefix+"*"))
 	var downloadedPath string
 	var modTime int64
-	for _, m := range mp4Matches {
+	for _, m := range matches {
+		if strings.HasSuffix(m, ".part") || strings.HasSuffix(m, ".ytdl") {
+			continue
+		}
 		if info, err := os.Stat(m); err == nil && info.ModTime().Unix() > modTime {
 			modTime = info.ModTime().Unix()
 			downloadedPath = m
@@ -364,17 +859,28 @@ func (s *YtDlpService) DownloadMergedToFile(ctx context.Context, sourceURL, form
 		return "", "", nil, fmt.Errorf("could not find downloaded file")
 	}
 
+	if opts.SplitChapters {
+		// Only the chapters are delivered, not the whole video
+		zipPath := strings.TrimSuffix(downloadedPath, filepath.Ext(downloadedPath)) + ".zip"
+		err := zipChapters(chapterDir, zipPath)
+		os.Remove(downloadedPath)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("failed to pack chapters: %w", err)
+		}
+		downloadedPath = zipPath
+	}
+
 	cleanup = func() {
 		os.Remove(downloadedPath)
 	}
 
-	filename = filepath.Base(downloadedPath)
+	filename = strings.TrimPrefix(filepath.Base(downloadedPath), prefix)
 	return downloadedPath, filename, cleanup, nil
 }
 
 // StreamToWriter streams video directly to a writer (for single format or audio-only)
 func (s *YtDlpService) StreamToWriter(ctx context.Context, url, formatID string, w io.Writer, isAudioOnly bool) (filename string, err error) {
-	_, err = s.validator.ValidateURL(url)
+	_, err = s.mediaRef(url)
 	if err != nil {
 		return "", err
 	}
@@ -398,18 +904,32 @@ func (s *YtDlpService) StreamToWriter(ctx context.Context, url, formatID string,
 		args = append(args, "--proxy", s.proxyURL)
 	}
 
-	args = append(args, url)
+	// The same run writes the filename to a file, since stdout carries the
+	// video; asking for it separately would extract the video twice
+	nameFile, err := createTempFile("filename_*.txt")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	nameFile.Close()
+	defer os.Remove(nameFile.Name())
+	args = append(args, "--print-to-file", "%(title)s.%(ext)s", nameFile.Name())
+
+	source, cleanup := s.sourceArgs(url)
+	defer cleanup()
+
+	args = append(args, source...)
 
 	cmd := exec.CommandContext(ctx, s.ytdlpPath, args...)
 	cmd.Stdout = w
 	cmd.Stderr = os.Stderr
 
-	filename, _ = s.GetFilename(ctx, url, formatID)
+	err = cmd.Run()
+	if name, readErr := os.ReadFile(nameFile.Name()); readErr == nil {
+		filename, _, _ = strings.Cut(strings.TrimSpace(string(name)), "\n")
+	}
 	if filename == "" {
 		filename = "video.mp4"
 	}
-
-	err = cmd.Run()
 	if err != nil {
 		return filename, fmt.Errorf("stream failed: %w", err)
 	}
@@ -417,6 +937,20 @@ func (s *YtDlpService) StreamToWriter(ctx context.Context, url, formatID string,
 	return filename, nil
 }
 
+// audioOptions are the conversions offered for the best audio besides m4a
+var audioOptions = []struct {
+	format  string
+	bitrate int
+	label   string
+}{
+	{"mp3", 320, "MP3 320 kbps"},
+	{"mp3", 192, "MP3 192 kbps"},
+	{"mp3", 128, "MP3 128 kbps"},
+	{"opus", 0, "Opus"},
+	{"flac", 0, "FLAC (без потерь)"},
+	{"wav", 0, "WAV (без потерь)"},
+}
+
 func (s *YtDlpService) GetBestFormats(formats []Format) []Format {
 	var best []Format
 
@@ -437,50 +971,142 @@ func (s *YtDlpService) GetBestFormats(formats []Format) []Format {
 		}
 	}
 
-	// Add best audio option
+	// Add best audio options: converted to m4a for compatibility, the source
+	// as is, and the other conversions
 	if bestAudio != nil {
-		best = append(best, Format{
-			ID:      bestAudio.ID,
-			Type:    "audio",
-			Quality: "Лучшее аудио (" + bestAudio.Quality + ")",
-			Ext:     "m4a", // Always convert to m4a for compatibility
-			Size:    bestAudio.Size,
-		})
-	}
-
-	// Find best video formats by resolution and create video+audio combos
-	resolutions := []int{360, 480, 720, 1080}
-	resLabels := map[int]string{360: "360p", 480: "480p", 720: "720p HD", 1080: "1080p Full HD"}
-
-	for _, res := range resolutions {
-		for _, f := range formats {
-			if f.Type == "video" && strings.HasPrefix(f.Quality, strconv.Itoa(res)) {
-				// Video with audio (merged)
-				if bestAudio != nil {
-					best = append(best, Format{
-						ID:      f.ID + "+" + bestAudio.ID,
-						Type:    "video",
-						Quality: resLabels[res] + " (видео + аудио)",
-						Ext:     "mp4",
-						Size:    f.Size + bestAudio.Size,
-					})
+		audio := *bestAudio
+		audio.Quality = "Лучшее аудио (" + bestAudio.Quality + ")"
+		audio.Ext = "m4a"
+		audio.AudioFormat = "m4a"
+		best = append(best, audio)
+
+		original := *bestAudio
+		original.Quality = "Оригинал (" + bestAudio.Quality + ")"
+		best = append(best, original)
+
+		for _, o := range audioOptions {
+			converted := *bestAudio
+			converted.Quality = o.label
+			converted.Ext = AudioFormats[o.format].Ext
+			converted.AudioFormat = o.format
+			converted.AudioBitrate = o.bitrate
+			// The converted size isn't known up front
+			converted.Size = 0
+			converted.SizeApprox = false
+			best = append(best, converted)
+		}
+	}
+
+	// Find the best video format for every rung of the ladder and variant
+	// (high frame rate, HDR), and create video+audio combos
+	for _, res := range s.resolutions {
+		var variants []*Format
+		for i := range formats {
+			f := &formats[i]
+			if f.Type != "video" || !onRung(f, res) {
+				continue
+			}
+
+			replaced := false
+			for j, v := range variants {
+				if sameVariant(v, f) {
+					if betterVideo(f, v) {
+						variants[j] = f
+					}
+					replaced = true
+					break
 				}
-				// Video only (no audio)
-				best = append(best, Format{
-					ID:      f.ID,
-					Type:    "video_only",
-					Quality: resLabels[res] + " (только видео)",
-					Ext:     f.Ext,
-					Size:    f.Size,
-				})
-				break
 			}
+			if !replaced {
+				variants = append(variants, f)
+			}
+		}
+
+		for _, f := range variants {
+			label := resolutionLabel(res)
+			if f.FPS > 30 {
+				label += fmt.Sprintf(" %.0ffps", f.FPS)
+			}
+			if isHDR(f.DynamicRange) {
+				label += " HDR"
+			}
+
+			// Video with audio, merged into mp4
+			if bestAudio != nil {
+				merged := *f
+				merged.ID = f.ID + "+" + bestAudio.ID
+				merged.Type = "video"
+				merged.Quality = label + " (видео + аудио)"
+				merged.Ext = "mp4"
+				merged.Size = f.Size + bestAudio.Size
+				merged.SizeApprox = f.SizeApprox || bestAudio.SizeApprox
+				merged.ACodec = bestAudio.ACodec
+				merged.TBR = f.TBR + bestAudio.TBR
+				merged.Language = bestAudio.Language
+				// The merge re-encodes audio to AAC, so only video matters
+				merged.Conversion = conversionFor(f.Ext, f.VCodec, "")
+				best = append(best, merged)
+			}
+			// Video only (no audio), converted to mp4 on download if needed
+			videoOnly := *f
+			videoOnly.Type = "video_only"
+			videoOnly.Quality = label + " (только видео)"
+			videoOnly.Ext = "mp4"
+			best = append(best, videoOnly)
 		}
 	}
 
 	return best
 }
 
+// onRung reports whether a video belongs to the ladder rung res. The short
+// side is compared so vertical videos match, and the long side so letterboxed
+// widescreen videos (e.g. 1920x800) match the rung of their width.
+func onRung(f *Format, res int) bool {
+	if f.Width == 0 || f.Height == 0 {
+		return f.Height == res
+	}
+	short, long := min(f.Width, f.Height), max(f.Width, f.Height)
+	if short == res {
+		return true
+	}
+	wide := float64(res) * 16 / 9
+	return short < res && math.Abs(float64(long)-wide) <= wide*0.02
+}
+
+func sameVariant(a, b *Format) bool {
+	return (a.FPS > 30) == (b.FPS > 30) && isHDR(a.DynamicRange) == isHDR(b.DynamicRange)
+}
+
+// betterVideo reports whether a is preferred over b for the same variant:
+// mp4 first, since it needs no remux, then the higher bitrate
+func betterVideo(a, b *Format) bool {
+	if (a.Ext == "mp4") != (b.Ext == "mp4") {
+		return a.Ext == "mp4"
+	}
+	return a.TBR > b.TBR
+}
+
+func isHDR(dynamicRange string) bool {
+	return dynamicRange != "" && dynamicRange != "SDR"
+}
+
+func resolutionLabel(res int) string {
+	switch res {
+	case 720:
+		return "720p HD"
+	case 1080:
+		return "1080p Full HD"
+	case 1440:
+		return "1440p 2K"
+	case 2160:
+		return "2160p 4K"
+	case 4320:
+		return "4320p 8K"
+	}
+	return fmt.Sprintf("%dp", res)
+}
+
 // GetFilename returns the filename for a given URL and format without downloading
 func (s *YtDlpService) GetFilename(ctx context.Context, url, formatID string) (string, error) {
 	// For merged formats, use the base format ID
@@ -490,13 +1116,16 @@ func (s *YtDlpService) GetFilename(ctx context.Context, url, formatID string) (s
 		baseFormatID = parts[0]
 	}
 
-	cmd := exec.CommandContext(ctx, s.ytdlpPath,
+	source, cleanup := s.sourceArgs(url)
+	defer cleanup()
+
+	args := []string{
 		"--get-filename",
 		"-f", baseFormatID,
 		"-o", "%(title)s.%(ext)s",
 		"--no-warnings",
-		url,
-	)
+	}
+	cmd := exec.CommandContext(ctx, s.ytdlpPath, append(args, source...)...)
 
 	output, err := cmd.Output()
 	if err != nil {
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseFormatsKeepsHighestBitrateDuplicate(t *testing.T) {
+	s := &YtDlpService{}
+	formats := s.parseFormats([]ytdlpFormat{
+		{FormatID: "139", Ext: "m4a", VCodec: "none", ACodec: "mp4a.40.5", ABR: 49, TBR: 49},
+		{FormatID: "134-low", Ext: "mp4", VCodec: "avc1.4d401e", ACodec: "none", Height: 360, Width: 640, FPS: 30, TBR: 250},
+		{FormatID: "134", Ext: "mp4", VCodec: "avc1.4d401e", ACodec: "none", Height: 360, Width: 640, FPS: 30, TBR: 600},
+		{FormatID: "134-drc", Ext: "mp4", VCodec: "avc1.4d401e", ACodec: "none", Height: 360, Width: 640, FPS: 30, TBR: 400},
+		{FormatID: "243", Ext: "webm", VCodec: "vp9", ACodec: "none", Height: 360, Width: 640, FPS: 30, TBR: 300},
+	})
+
+	want := []string{"139", "134", "243"}
+	if len(formats) != len(want) {
+		t.Fatalf("got %d formats, want %v", len(formats), want)
+	}
+	for i, id := range want {
+		if formats[i].ID != id {
+			t.Fatalf("format %d = %s, want %s", i, formats[i].ID, id)
+		}
+	}
+}
+
+func TestStreamToWriterRunsYtDlpOnce(t *testing.T) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	// Writes the --print-to-file template's value and streams to stdout
+	script := `#!/bin/sh
+echo run >> ` + calls + `
+while [ $# -gt 0 ]; do
+	if [ "$1" = --print-to-file ]; then
+		echo "Never Gonna Give You Up.webm" >> "$3"
+		shift 2
+	fi
+	shift
+done
+printf 'video data'
+`
+	ytdlp := filepath.Join(dir, "yt-dlp")
+	if err := os.WriteFile(ytdlp, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := NewYtDlpService(ytdlp, "ffmpeg", "", "", NewValidator(), NewAnalyzeCache(time.Minute, 10),
+		NewFileCache(t.TempDir(), 0, 0, logger), nil, nil)
+
+	var out bytes.Buffer
+	filename, err := s.StreamToWriter(context.Background(), "https://www.youtube.com/watch?v=dQw4w9WgXcQ", "251", &out, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename != "Never Gonna Give You Up.webm" || out.String() != "video data" {
+		t.Fatalf("StreamToWriter = %q, %q", filename, out.String())
+	}
+	if runs, _ := os.ReadFile(calls); string(runs) != "run\n" {
+		t.Fatalf("yt-dlp ran %d times, want once", bytes.Count(runs, []byte("run")))
+	}
+}
@@ -20,6 +20,7 @@ function App() {
   const [currentUrl, setCurrentUrl] = useState('');
   const [error, setError] = useState<string | null>(null);
   const [downloadProgress, setDownloadProgress] = useState(0);
+  const [queuePosition, setQueuePosition] = useState(0);
 
   const handleAnalyze = useCallback(async (url: string) => {
     setError(null);
@@ -60,6 +61,15 @@ function App() {
           setState('downloading');
         },
         selectedFormat.size,
+        {
+          audioFormat: selectedFormat.audio_format,
+          audioBitrate: selectedFormat.audio_bitrate,
+          // Converted audio gets tags and cover art
+          embedMetadata: !!selectedFormat.audio_format,
+          convert: selectedFormat.conversion,
+          token: selectedFormat.token,
+          onQueuePosition: setQueuePosition,
+        },
       );
       setState('ready');
       setDownloadProgress(0);
@@ -234,6 +244,7 @@ function App() {
                   isProcessing={state === 'processing'}
                   isDownloading={state === 'downloading'}
                   progress={downloadProgress}
+                  queuePosition={queuePosition}
                 />
               </motion.div>
 
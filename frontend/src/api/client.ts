@@ -4,18 +4,34 @@ const API_BASE = '/api';
 
 class ApiError extends Error {
   status: number;
+  code?: string;
   
-  constructor(status: number, message: string) {
+  constructor(status: number, message: string, code?: string) {
     super(message);
     this.name = 'ApiError';
     this.status = status;
+    this.code = code;
+  }
+}
+
+// Sends the browser to the SSO login when the session is missing or expired,
+// returning to the current page afterwards
+async function redirectToLogin(status: number, code?: string): Promise<void> {
+  if (status !== 401 || code !== 'unauthenticated') {
+    return;
+  }
+  const config = await getConfig().catch(() => null);
+  if (config?.loginUrl) {
+    const returnTo = window.location.pathname + window.location.search;
+    window.location.assign(`${config.loginUrl}?return_to=${encodeURIComponent(returnTo)}`);
   }
 }
 
 async function handleResponse<T>(response: Response): Promise<T> {
   if (!response.ok) {
     const error: ErrorResponse = await response.json().catch(() => ({ error: 'Unknown error' }));
-    throw new ApiError(response.status, error.error);
+    await redirectToLogin(response.status, error.code);
+    throw new ApiError(response.status, error.error, error.code);
   }
   return response.json();
 }
@@ -36,17 +52,104 @@ export async function analyzeUrl(url: string): Promise<VideoInfo> {
   return handleResponse<VideoInfo>(response);
 }
 
-export function getDownloadUrl(url: string, formatId: string, formatType?: string): string {
-  const params = new URLSearchParams({
-    url: url,
-    format_id: formatId,
-  });
-  if (formatType) {
-    params.set('type', formatType);
+export interface DownloadOptions {
+  audioFormat?: string;
+  audioBitrate?: number;
+  embedMetadata?: boolean;
+  start?: string;
+  end?: string;
+  precise?: boolean;
+  chapter?: number;
+  splitChapters?: boolean;
+  subtitles?: string[];
+  subtitleMode?: 'embed' | 'srt' | 'vtt' | 'ass';
+  preset?: string;
+  convert?: 'remux' | 'transcode';
+  // Token of the format from /analyze; replaces url, format_id and type
+  token?: string;
+  // Called with the place in the download queue while the request waits
+  onQueuePosition?: (position: number) => void;
+  queueTicket?: string;
+}
+
+export function getDownloadUrl(url: string, formatId: string, formatType?: string, options?: DownloadOptions): string {
+  const params = new URLSearchParams();
+  if (options?.token) {
+    params.set('token', options.token);
+  } else {
+    params.set('url', url);
+    params.set('format_id', formatId);
+    if (formatType) {
+      params.set('type', formatType);
+    }
+  }
+  if (options?.audioFormat) {
+    params.set('audio_format', options.audioFormat);
+  }
+  if (options?.audioBitrate) {
+    params.set('audio_bitrate', String(options.audioBitrate));
+  }
+  if (options?.embedMetadata) {
+    params.set('embed_metadata', 'true');
+  }
+  if (options?.start) {
+    params.set('start', options.start);
+  }
+  if (options?.end) {
+    params.set('end', options.end);
+  }
+  if (options?.precise) {
+    params.set('precise', 'true');
+  }
+  if (options?.chapter) {
+    params.set('chapter', String(options.chapter));
+  }
+  if (options?.splitChapters) {
+    params.set('split_chapters', 'true');
+  }
+  if (options?.subtitles?.length && options.subtitleMode) {
+    params.set('subtitles', options.subtitles.join(','));
+    params.set('subtitle_mode', options.subtitleMode);
+  }
+  if (options?.preset) {
+    params.set('preset', options.preset);
+  }
+  if (options?.convert) {
+    params.set('convert', options.convert);
+  }
+  if (options?.queueTicket) {
+    params.set('queue_ticket', options.queueTicket);
   }
   return `${API_BASE}/download?${params.toString()}`;
 }
 
+function newQueueTicket(): string {
+  const bytes = crypto.getRandomValues(new Uint8Array(16));
+  return Array.from(bytes, (b) => b.toString(16).padStart(2, '0')).join('');
+}
+
+// Polls the queue position of a waiting download until the returned func is called
+function pollQueuePosition(ticket: string, onPosition: (position: number) => void): () => void {
+  let stopped = false;
+  const timer = setInterval(async () => {
+    try {
+      const response = await fetch(`${API_BASE}/queue/${ticket}`);
+      if (response.ok && !stopped) {
+        const { position } = await response.json();
+        if (!stopped) {
+          onPosition(position);
+        }
+      }
+    } catch {
+      // Best effort; the download itself reports errors
+    }
+  }, 2000);
+  return () => {
+    stopped = true;
+    clearInterval(timer);
+  };
+}
+
 export function getThumbnailUrl(originalUrl: string): string {
   const params = new URLSearchParams({
     url: originalUrl,
@@ -62,14 +165,29 @@ export async function downloadFile(
   onProgress?: (progress: number) => void,
   onStreamingStart?: () => void,
   expectedSize?: number,
+  options?: DownloadOptions,
 ): Promise<void> {
-  const downloadUrl = getDownloadUrl(url, formatId, formatType);
+  const onQueuePosition = options?.onQueuePosition;
+  let stopPolling = () => {};
+  if (onQueuePosition) {
+    const queueTicket = newQueueTicket();
+    options = { ...options, queueTicket };
+    stopPolling = pollQueuePosition(queueTicket, onQueuePosition);
+  }
+  const downloadUrl = getDownloadUrl(url, formatId, formatType, options);
   
-  const response = await fetch(downloadUrl);
+  let response: Response;
+  try {
+    response = await fetch(downloadUrl);
+  } finally {
+    stopPolling();
+    onQueuePosition?.(0);
+  }
   
   if (!response.ok) {
-    const error = await response.json().catch(() => ({ error: 'Download failed' }));
-    throw new ApiError(response.status, error.error || 'Download failed');
+    const error: ErrorResponse = await response.json().catch(() => ({ error: 'Download failed' }));
+    await redirectToLogin(response.status, error.code);
+    throw new ApiError(response.status, error.error || 'Download failed', error.code);
   }
   
   // Get filename from Content-Disposition header
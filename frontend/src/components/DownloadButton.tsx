@@ -7,6 +7,7 @@ interface DownloadButtonProps {
   isProcessing?: boolean;
   isDownloading: boolean;
   progress?: number;
+  queuePosition?: number;
 }
 
 export function DownloadButton({ 
@@ -14,7 +15,8 @@ export function DownloadButton({
   disabled, 
   isProcessing,
   isDownloading, 
-  progress = 0 
+  progress = 0,
+  queuePosition = 0,
 }: DownloadButtonProps) {
   const isBusy = isProcessing || isDownloading;
   const isStreaming = isDownloading && progress > 0;
@@ -73,7 +75,7 @@ export function DownloadButton({
         {isProcessing ? (
           <>
             <Server className="w-4 h-4 animate-pulse flex-shrink-0" />
-            <span>Скачивание на сервере...</span>
+            <span>{queuePosition > 0 ? `В очереди: ${queuePosition}` : 'Скачивание на сервере...'}</span>
           </>
         ) : isDownloading ? (
           <>
@@ -37,6 +37,26 @@ export function FormatSelector({ formats, selectedFormat, onSelect, disabled }:
     return `${mb.toFixed(1)} MB`;
   };
 
+  const codecLabel = (codec?: string) => {
+    if (!codec) return '';
+    if (codec.startsWith('avc1')) return 'H.264';
+    if (codec.startsWith('hev1') || codec.startsWith('hvc1')) return 'H.265';
+    if (codec.startsWith('av01')) return 'AV1';
+    if (codec.startsWith('vp09') || codec.startsWith('vp9')) return 'VP9';
+    if (codec.startsWith('mp4a')) return 'AAC';
+    return codec.split('.')[0].toUpperCase();
+  };
+
+  const formatDetails = (format: Format) => {
+    const details = [format.ext.toUpperCase()];
+    if (format.vcodec) details.push(codecLabel(format.vcodec));
+    if (format.fps && format.fps > 30) details.push(`${Math.round(format.fps)} fps`);
+    if (format.dynamic_range && format.dynamic_range !== 'SDR') details.push(format.dynamic_range);
+    if (format.type === 'audio' && !format.audio_format && format.acodec) details.push(codecLabel(format.acodec));
+    if (format.conversion === 'transcode') details.push('перекодирование');
+    return details.join(' · ');
+  };
+
   return (
     <div className="space-y-5">
       {/* Tabs */}
@@ -76,10 +96,12 @@ export function FormatSelector({ formats, selectedFormat, onSelect, disabled }:
           <p className="py-6 text-gray-500 text-center text-sm">Нет доступных форматов</p>
         ) : (
           currentFormats.map((format, index) => {
-            const isSelected = selectedFormat?.id === format.id;
+            const isSelected = selectedFormat?.id === format.id &&
+              selectedFormat?.audio_format === format.audio_format &&
+              selectedFormat?.audio_bitrate === format.audio_bitrate;
             return (
               <motion.button
-                key={format.id}
+                key={`${format.id}-${format.audio_format ?? ''}-${format.audio_bitrate ?? ''}`}
                 initial={{ opacity: 0, x: -10 }}
                 animate={{ opacity: 1, x: 0 }}
                 transition={{ delay: index * 0.03 }}
@@ -112,7 +134,7 @@ export function FormatSelector({ formats, selectedFormat, onSelect, disabled }:
                     {format.quality}
                   </p>
                   <p className="text-xs text-gray-600 truncate mt-1">
-                    {format.ext.toUpperCase()}
+                    {formatDetails(format)}
                     {format.type === 'video_only' && ' (без звука)'}
                   </p>
                 </div>
@@ -123,7 +145,7 @@ export function FormatSelector({ formats, selectedFormat, onSelect, disabled }:
                       ? 'text-violet-400 bg-violet-500/10'
                       : 'text-gray-600 bg-white/3'
                   }`}>
-                    {formatSize(format.size)}
+                    {format.size_approx && '~'}{formatSize(format.size)}
                   </span>
                 )}
               </motion.button>
@@ -4,6 +4,19 @@ export interface Format {
   quality: string;
   ext: string;
   size?: number;
+  size_approx?: boolean;
+  vcodec?: string;
+  acodec?: string;
+  width?: number;
+  height?: number;
+  fps?: number;
+  dynamic_range?: string;
+  tbr?: number;
+  language?: string;
+  audio_format?: string;
+  audio_bitrate?: number;
+  conversion?: 'remux' | 'transcode';
+  token?: string;
 }
 
 export interface VideoInfo {
@@ -12,12 +25,53 @@ export interface VideoInfo {
   duration: number;
   thumbnail: string;
   formats: Format[];
+  tags?: Tags;
+  chapters?: Chapter[];
+  subtitles?: SubtitleTrack[];
+}
+
+export interface SubtitleTrack {
+  language: string;
+  name?: string;
+  auto?: boolean;
+}
+
+export interface Chapter {
+  number: number;
+  title: string;
+  start: number;
+  end: number;
+}
+
+export interface Tags {
+  title?: string;
+  artist?: string;
+  album?: string;
+  date?: string;
+  track?: number;
 }
 
 export interface ConfigResponse {
   authRequired: boolean;
   maxConcurrent: number;
   platforms: string[];
+  audioFormats?: string[];
+  presets?: Preset[];
+  // Set when the UI signs in through OIDC
+  loginUrl?: string;
+}
+
+export interface Preset {
+  name: string;
+  label: string;
+  max_size_mb?: number;
+  max_height?: number;
+  video_codec: 'h264' | 'h265';
+  profile?: string;
+  level?: string;
+  max_video_bitrate?: number;
+  audio_bitrate: number;
+  crf?: number;
 }
 
 export interface AnalyzeRequest {
@@ -26,6 +80,7 @@ export interface AnalyzeRequest {
 
 export interface ErrorResponse {
   error: string;
+  code?: string;
 }
 
 export type AppState = 'idle' | 'analyzing' | 'ready' | 'processing' | 'downloading' | 'error';